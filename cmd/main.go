@@ -1,18 +1,28 @@
 package main
 
 import (
+    "context"
     "bufio"
+    "errors"
     "fmt"
+    "math/rand/v2"
+    "net"
     "os"
+    "os/signal"
     "strings"
     "sync"
+    "syscall"
     "time"
 
     "github.com/Dyst0rti0n/gonetdiag/internal/bandwidth"
+    "github.com/Dyst0rti0n/gonetdiag/internal/bufferbloat"
+    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
     "github.com/Dyst0rti0n/gonetdiag/internal/latency"
     "github.com/Dyst0rti0n/gonetdiag/internal/packetloss"
     "github.com/Dyst0rti0n/gonetdiag/internal/ping"
     "github.com/Dyst0rti0n/gonetdiag/internal/report"
+    "github.com/Dyst0rti0n/gonetdiag/internal/sweep"
+    "github.com/Dyst0rti0n/gonetdiag/internal/targets"
     "github.com/Dyst0rti0n/gonetdiag/internal/traceroute"
     "github.com/Dyst0rti0n/gonetdiag/web"
     "github.com/fatih/color"
@@ -25,165 +35,628 @@ func main() {
     var rootCmd = &cobra.Command{Use: "gonetdiag"}
 
     rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
+    rootCmd.PersistentFlags().BoolP("ipv4", "4", false, "Use IPv4 only")
+    rootCmd.PersistentFlags().BoolP("ipv6", "6", false, "Use IPv6 only")
+    rootCmd.PersistentFlags().Bool("privileged", false, "Use raw ICMP sockets instead of falling back to unprivileged ones")
 
-    rootCmd.AddCommand(&cobra.Command{
-        Use:   "ping [target]",
-        Short: "Ping a target",
-        Args:  cobra.MinimumNArgs(1),
+    pingCmd := &cobra.Command{
+        Use:   "ping [target...]",
+        Short: "Ping one or more targets",
+        Long:  "Ping one or more targets. Targets may be hostnames, addresses or CIDR ranges, and can also be read from a file with --file. With more than one target they are probed in parallel and summarised in a table.",
         Run: func(cmd *cobra.Command, args []string) {
-            target := args[0]
-            count, _ := cmd.Flags().GetInt("count")
-            timeout, _ := cmd.Flags().GetDuration("timeout")
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            o, err := pingOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            o.Interval, _ = cmd.Flags().GetDuration("interval")
+            file, _ := cmd.Flags().GetString("file")
 
-            result, err := ping.Ping(target, count, timeout)
+            hosts, err := targets.Expand(args)
+            if err != nil {
+                color.Red("Ping error: %v", err)
+                return
+            }
+            if file != "" {
+                fromFile, err := targets.ReadFile(file)
+                if err != nil {
+                    color.Red("Ping error: %v", err)
+                    return
+                }
+                hosts = append(hosts, fromFile...)
+            }
+            if len(hosts) == 0 {
+                color.Red("Ping error: no targets given")
+                return
+            }
+
+            // Ctrl-C ends the run early but still prints the summary.
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+
+            if len(hosts) > 1 || file != "" || strings.Contains(args[0], "/") {
+                concurrency, _ := cmd.Flags().GetInt("concurrency")
+                rate, _ := cmd.Flags().GetInt("rate")
+                results, err := ping.PingMany(ctx, hosts, ping.MultiOptions{
+                    Options:     o,
+                    Concurrency: concurrency,
+                    Rate:        rate,
+                })
+                if err != nil {
+                    color.Red("Ping error: %v", err)
+                    return
+                }
+                printPingMany(results)
+                return
+            }
+
+            target := hosts[0]
+            o.OnSample = func(s ping.Sample) {
+                if o.Proto == "udp" {
+                    switch {
+                    case s.Error != "":
+                        color.Red("From %s udp_seq=%d %s", s.From, s.Seq, s.Error)
+                    case !s.Received:
+                        color.Yellow("Request timeout for udp_seq=%d", s.Seq)
+                    default:
+                        fmt.Printf("%d bytes from %s port %d: udp_seq=%d time=%.3f ms\n",
+                            s.Bytes, target, o.Port, s.Seq, float64(s.RTT)/float64(time.Millisecond))
+                    }
+                    return
+                }
+                if o.Proto == "tcp" {
+                    switch {
+                    case s.Error != "":
+                        color.Red("Connect to %s port %d seq=%d failed: %s", target, o.Port, s.Seq, s.Error)
+                    case !s.Received:
+                        color.Yellow("Connect timeout for seq=%d", s.Seq)
+                    default:
+                        fmt.Printf("Connected to %s port %d: seq=%d time=%.3f ms\n",
+                            target, o.Port, s.Seq, float64(s.RTT)/float64(time.Millisecond))
+                    }
+                    return
+                }
+                if s.Error != "" {
+                    color.Red("From %s icmp_seq=%d %s", s.From, s.Seq, s.Error)
+                    return
+                }
+                if !s.Received {
+                    color.Yellow("Request timeout for icmp_seq=%d", s.Seq)
+                    return
+                }
+                fmt.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%.3f ms\n",
+                    s.Bytes, target, s.Seq, s.TTL, float64(s.RTT)/float64(time.Millisecond))
+            }
+            result, err := ping.Ping(ctx, target, o)
             if err != nil {
                 color.Red("Ping error: %v", err)
                 return
             }
             color.Cyan("Ping Result:\n%s", result)
         },
-    })
+    }
+    pingCmd.Flags().DurationP("interval", "i", time.Second, "Time between pings")
+    pingCmd.Flags().StringP("file", "f", "", "Read targets from a file, one per line")
+    pingCmd.Flags().Int("concurrency", 64, "Maximum number of targets to ping at once")
+    pingCmd.Flags().Int("rate", 100, "Maximum pings per second across all targets")
+    addProtoFlags(pingCmd)
+    rootCmd.AddCommand(pingCmd)
 
-    rootCmd.PersistentFlags().IntP("count", "c", 4, "Number of pings")
+    rootCmd.PersistentFlags().IntP("count", "c", 4, "Number of pings (0 for ping to run until interrupted)")
     rootCmd.PersistentFlags().DurationP("timeout", "t", 5*time.Second, "Timeout for each ping")
 
-    rootCmd.AddCommand(&cobra.Command{
+    tracerouteCmd := &cobra.Command{
         Use:   "traceroute [target]",
         Short: "Traceroute to a target",
         Args:  cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
             target := args[0]
-            result, err := traceroute.TraceRoute(target)
+            o, err := traceOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            o.Queries, _ = cmd.Flags().GetInt("queries")
+            if o.Queries < 1 {
+                color.Red("--queries must be at least 1")
+                return
+            }
+            o.SimQueries, _ = cmd.Flags().GetInt("sim-queries")
+            if o.SimQueries < 1 {
+                color.Red("--sim-queries must be at least 1")
+                return
+            }
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+            var hops []traceroute.Hop
+            err = retryFlowID(cmd, &o, func() (err error) {
+                hops, err = traceroute.Trace(ctx, target, o)
+                return err
+            })
             if err != nil {
                 color.Red("Traceroute error: %v", err)
                 return
             }
-            color.Cyan("Traceroute Result:\n%s", result)
+            color.Cyan("Traceroute Result (flow ID %d):\n%s", o.FlowID, traceroute.Format(hops))
         },
-    })
+    }
+    addTraceFlags(tracerouteCmd)
+    tracerouteCmd.Flags().IntP("queries", "q", traceroute.DefaultQueries, fmt.Sprintf("Number of probes to send to each hop, up to %d", traceroute.MaxQueries))
+    tracerouteCmd.Flags().IntP("sim-queries", "N", traceroute.DefaultSimQueries, fmt.Sprintf("Number of probes in flight at once, up to %d", traceroute.MaxSimQueries))
+    rootCmd.AddCommand(tracerouteCmd)
 
-    rootCmd.AddCommand(&cobra.Command{
+    mtrCmd := &cobra.Command{
+        Use:   "mtr [target]",
+        Short: "Trace the route to a target and keep probing every hop",
+        Args:  cobra.MinimumNArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+            target := args[0]
+            trace, err := traceOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            cycles, _ := cmd.Flags().GetInt("report-cycles")
+            if cmd.Flags().Changed("count") && !cmd.Flags().Changed("report-cycles") {
+                // As in mtr(8), -c sets the number of cycles.
+                cycles, _ = cmd.Flags().GetInt("count")
+            }
+            if cycles < 0 {
+                color.Red("--report-cycles must not be negative")
+                return
+            }
+            interval, _ := cmd.Flags().GetDuration("interval")
+            o := traceroute.MTROptions{
+                Options:  trace,
+                Cycles:   cycles,
+                Interval: interval,
+            }
+            if cycles == 0 {
+                // Redraw the table in place after every round.
+                o.OnRound = func(r *traceroute.MTRResult) {
+                    fmt.Print("\033[H\033[2J")
+                    fmt.Print(r)
+                }
+            }
+
+            // Ctrl-C ends the run but still prints the table.
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+            var result *traceroute.MTRResult
+            err = retryFlowID(cmd, &o.Options, func() (err error) {
+                result, err = traceroute.MTR(ctx, target, o)
+                return err
+            })
+            if err != nil {
+                color.Red("MTR error: %v", err)
+                return
+            }
+            color.Cyan("MTR Result:\n%s", result)
+        },
+    }
+    mtrCmd.Flags().Int("report-cycles", 0, "Probe every hop this many times, then print the table (0 to refresh it until interrupted; -c sets it too)")
+    mtrCmd.Flags().DurationP("interval", "i", time.Second, "Time between rounds of probes")
+    addTraceFlags(mtrCmd)
+    rootCmd.AddCommand(mtrCmd)
+
+    bandwidthCmd := &cobra.Command{
         Use:   "bandwidth [target] [protocol]",
         Short: "Measure bandwidth to a target",
-        Args:  cobra.MinimumNArgs(2),
+        Long:  "Measure bandwidth to a target. The protocol is http or https to upload to and download from a web server, or probe to run upload, download and UDP tests against a gonetdiag serve-probe server. With --iperf3 the target is an iperf3 server and no protocol is needed. With --udp and no protocol, probe is assumed and a UDP throughput test is run at --rate.",
+        Args:  cobra.RangeArgs(1, 2),
         Run: func(cmd *cobra.Command, args []string) {
             target := args[0]
-            protocol := args[1]
-            uploadResult, err := bandwidth.MeasureUploadBandwidth(target)
+            o, err := bandwidthOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            if iperf3, _ := cmd.Flags().GetBool("iperf3"); iperf3 {
+                runIperf3Tests(target, o)
+                return
+            }
+            protocol := "probe"
+            if len(args) == 2 {
+                protocol = args[1]
+            } else if !o.UDP {
+                color.Red("Bandwidth error: no protocol given")
+                return
+            }
+            if o.UDP {
+                if protocol != "probe" {
+                    color.Red("Bandwidth error: --udp needs --iperf3 or the probe protocol")
+                    return
+                }
+                runUDPThroughputTest(target, o)
+                return
+            }
+            if protocol == "probe" {
+                runProbeTests(target, o)
+                return
+            }
+            uploadTarget := target
+            if url, _ := cmd.Flags().GetString("upload-url"); url != "" {
+                uploadTarget = url
+            }
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+            uploadResult, err := bandwidth.MeasureHTTPUploadBandwidth(ctx, uploadTarget, protocol, o)
             if err != nil {
                 color.Red("Upload Bandwidth measurement error: %v", err)
                 return
             }
-            downloadResult, err := bandwidth.MeasureDownloadBandwidth(target, protocol)
+            color.Cyan("Upload Bandwidth Result:\n%s", uploadResult)
+            downloadResult, err := bandwidth.MeasureDownloadBandwidth(ctx, target, protocol, o)
             if err != nil {
                 color.Red("Download Bandwidth measurement error: %v", err)
                 return
             }
-            color.Cyan("Upload Bandwidth Result:\n%s", uploadResult)
             color.Cyan("Download Bandwidth Result:\n%s", downloadResult)
         },
-    })
+    }
+    bandwidthCmd.Flags().Duration("duration", bandwidth.DefaultDuration, "How long to measure each direction for, after the warm-up")
+    bandwidthCmd.Flags().IntP("parallel", "P", 1, "Number of parallel streams")
+    bandwidthCmd.Flags().DurationP("interval", "i", 0, "Report throughput every interval (0 for no periodic reports)")
+    bandwidthCmd.Flags().Duration("warmup", time.Second, "Time to run before measuring, left out of the result")
+    bandwidthCmd.Flags().String("upload-size", "0", "Size of each stream's HTTP upload body, such as 512K or 100M (0 to upload for the whole duration)")
+    bandwidthCmd.Flags().String("upload-method", "POST", "HTTP upload method, POST or PUT")
+    bandwidthCmd.Flags().String("upload-url", "", "URL to upload to, if not the target")
+    bandwidthCmd.Flags().Bool("iperf3", false, "Test against an iperf3 server (port 5201 unless given)")
+    bandwidthCmd.Flags().Bool("udp", false, "Send UDP datagrams at --rate instead of TCP, to an iperf3 or serve-probe server")
+    bandwidthCmd.Flags().String("rate", "1M", "Target UDP bit rate per stream, such as 500K, 50M or 1G")
+    rootCmd.AddCommand(bandwidthCmd)
 
-    rootCmd.AddCommand(&cobra.Command{
+    httpCmd := &cobra.Command{
+        Use:   "http [url]",
+        Short: "Break an HTTP request down into its phases",
+        Long:  "Fetch a URL over a fresh connection and report how long the DNS lookup, TCP connect, TLS handshake, server processing and content transfer took, along with the status, HTTP version, TLS version and cipher, and response size. The URL defaults to https if it has no scheme.",
+        Args:  cobra.ExactArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+            var o bandwidth.HTTPOptions
+            if cmd.Flags().Changed("timeout") {
+                o.Timeout, _ = cmd.Flags().GetDuration("timeout")
+            }
+            o.FollowRedirects, _ = cmd.Flags().GetBool("location")
+            o.Insecure, _ = cmd.Flags().GetBool("insecure")
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+            result, err := bandwidth.TimeHTTP(ctx, args[0], o)
+            if err != nil {
+                color.Red("HTTP error: %v", err)
+                return
+            }
+            color.Cyan("HTTP Result:\n%s", result)
+        },
+    }
+    httpCmd.Flags().BoolP("location", "L", false, "Follow redirects")
+    httpCmd.Flags().BoolP("insecure", "k", false, "Don't verify the server's certificate")
+    rootCmd.AddCommand(httpCmd)
+
+    bufferbloatCmd := &cobra.Command{
+        Use:   "bufferbloat [target] [protocol]",
+        Short: "Measure how much latency grows while the link is loaded",
+        Long:  "Measure the latency to a target while the link is idle, then while a download and an upload saturate it, and grade how much the load added. The load is generated like the bandwidth command's: the protocol is http (the default) or https to use a web server, or probe to use a gonetdiag serve-probe server. With --iperf3 the target is an iperf3 server.",
+        Args:  cobra.RangeArgs(1, 2),
+        Run: func(cmd *cobra.Command, args []string) {
+            target := args[0]
+            protocol := "http"
+            if len(args) == 2 {
+                protocol = args[1]
+            }
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            o, err := pingOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            o.Interval, _ = cmd.Flags().GetDuration("interval")
+            idle, _ := cmd.Flags().GetDuration("idle")
+            duration, _ := cmd.Flags().GetDuration("duration")
+            warmup, _ := cmd.Flags().GetDuration("warmup")
+            parallel, _ := cmd.Flags().GetInt("parallel")
+            iperf3, _ := cmd.Flags().GetBool("iperf3")
+
+            // Ping the host the load goes to, without the port the load
+            // may name.
+            host := target
+            if h, _, err := net.SplitHostPort(target); err == nil {
+                host = h
+            }
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+            download, upload := bandwidthLoads(target, protocol, iperf3)
+            result, err := bufferbloat.Run(ctx, host, bufferbloat.Options{
+                Ping:      o,
+                Idle:      idle,
+                Bandwidth: bandwidth.Options{Duration: duration, WarmUp: warmup, Parallel: parallel},
+                Download:  download,
+                Upload:    upload,
+            })
+            if err != nil {
+                color.Red("Bufferbloat test error: %v", err)
+                return
+            }
+            color.Cyan("Bufferbloat Result:\n%s", result)
+        },
+    }
+    addProtoFlags(bufferbloatCmd)
+    bufferbloatCmd.Flags().DurationP("interval", "i", 100*time.Millisecond, "Time between pings")
+    bufferbloatCmd.Flags().Duration("idle", bufferbloat.DefaultIdle, "How long to measure latency for before loading the link")
+    bufferbloatCmd.Flags().Duration("duration", 10*time.Second, "How long to load each direction for, after the warm-up")
+    bufferbloatCmd.Flags().Duration("warmup", 2*time.Second, "Time to load the link for before measuring latency, so its queues fill")
+    bufferbloatCmd.Flags().IntP("parallel", "P", 4, "Number of parallel streams loading the link")
+    bufferbloatCmd.Flags().Bool("iperf3", false, "Load the link with an iperf3 server (port 5201 unless given)")
+    rootCmd.AddCommand(bufferbloatCmd)
+
+    latencyCmd := &cobra.Command{
         Use:   "latency [target]",
         Short: "Analyze latency to a target",
         Args:  cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
             target := args[0]
-            count, _ := cmd.Flags().GetInt("count")
-            timeout, _ := cmd.Flags().GetDuration("timeout")
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
 
-            result, err := latency.AnalyzeLatency(target, count, timeout)
+            o, err := pingOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            result, err := latency.AnalyzeLatency(target, o)
             if err != nil {
                 color.Red("Latency analysis error: %v", err)
                 return
             }
             color.Cyan("Latency Result:\n%s", result)
         },
-    })
+    }
+    addProtoFlags(latencyCmd)
+    rootCmd.AddCommand(latencyCmd)
 
-    rootCmd.AddCommand(&cobra.Command{
+    packetLossCmd := &cobra.Command{
         Use:   "packetloss [target]",
         Short: "Detect packet loss to a target",
         Args:  cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
             target := args[0]
-            count, _ := cmd.Flags().GetInt("count")
-            timeout, _ := cmd.Flags().GetDuration("timeout")
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
 
-            result, err := packetloss.DetectPacketLoss(target, count, timeout)
+            o, err := pingOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            result, err := packetloss.DetectPacketLoss(target, o)
             if err != nil {
                 color.Red("Packet loss detection error: %v", err)
                 return
             }
             color.Cyan("Packet Loss Result:\n%s", result)
         },
-    })
+    }
+    addProtoFlags(packetLossCmd)
+    rootCmd.AddCommand(packetLossCmd)
 
-    rootCmd.AddCommand(&cobra.Command{
+    serveProbeCmd := &cobra.Command{
+        Use:   "serve-probe",
+        Short: "Serve upload, download and UDP tests for bandwidth probe clients",
+        Run: func(cmd *cobra.Command, args []string) {
+            listen, _ := cmd.Flags().GetString("listen")
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+
+            server := &bandwidth.Server{Addr: listen}
+            if verbose {
+                server.Logf = func(format string, args ...interface{}) {
+                    fmt.Printf(format+"\n", args...)
+                }
+            }
+            color.Cyan("Serving bandwidth probes on %s (TCP and UDP)", listen)
+            if err := server.ListenAndServe(ctx); err != nil {
+                color.Red("Serve error: %v", err)
+            }
+        },
+    }
+    serveProbeCmd.Flags().String("listen", fmt.Sprintf(":%d", bandwidth.ServerPort), "Address to listen on")
+    rootCmd.AddCommand(serveProbeCmd)
+
+    reflectCmd := &cobra.Command{
+        Use:   "reflect",
+        Short: "Echo UDP probes back to their sender, for ping --proto udp",
+        Run: func(cmd *cobra.Command, args []string) {
+            listen, _ := cmd.Flags().GetString("listen")
+
+            conn, err := net.ListenPacket("udp", listen)
+            if err != nil {
+                color.Red("Reflect error: %v", err)
+                return
+            }
+            defer conn.Close()
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+
+            color.Cyan("Reflecting UDP probes on %s", conn.LocalAddr())
+            logf := func(format string, args ...interface{}) {
+                color.Red(format, args...)
+            }
+            if err := ping.Reflect(ctx, conn, logf); err != nil {
+                color.Red("Reflect error: %v", err)
+            }
+        },
+    }
+    reflectCmd.Flags().String("listen", fmt.Sprintf(":%d", ping.ReflectPort), "Address to listen on")
+    rootCmd.AddCommand(reflectCmd)
+
+    sweepCmd := &cobra.Command{
+        Use:   "sweep [cidr]",
+        Short: "Discover live hosts in a subnet",
+        Args:  cobra.MinimumNArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            sweepOpts, err := sweepOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
+
+            result, err := sweep.Sweep(ctx, args[0], sweepOpts)
+            if result == nil {
+                color.Red("Sweep error: %v", err)
+                return
+            }
+            color.Cyan("Sweep Result:\n%s", result)
+        },
+    }
+    addSweepFlags(sweepCmd)
+    rootCmd.AddCommand(sweepCmd)
+
+    reportCmd := &cobra.Command{
         Use:   "report [target]",
         Short: "Generate a network diagnostic report for a target",
         Args:  cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
             target := args[0]
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            subnet, _ := cmd.Flags().GetString("subnet")
+            sweepOpts, err := sweepOptions(cmd, opts)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+            traceOpts, err := traceOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
+
+            ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+            defer stop()
 
             var wg sync.WaitGroup
             wg.Add(5)
 
-            var pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult string
-            var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr error
+            r := &report.Report{Target: target}
+            var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr, sweepErr error
+
+            if subnet != "" {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    r.Subnet, sweepErr = sweep.Sweep(ctx, subnet, sweepOpts)
+                }()
+            }
 
             go func() {
                 defer wg.Done()
-                pingResult, pingErr = ping.Ping(target, 4, 5*time.Second)
+                r.Ping, pingErr = ping.Ping(ctx, target, ping.Options{Count: 4, Timeout: 5*time.Second, ICMP: opts})
             }()
 
+            // The MTR follows the trace rather than running beside it, as
+            // probes of one flow from both would answer each other's.
+            var mtrErr error
             go func() {
                 defer wg.Done()
-                traceResult, traceErr = traceroute.TraceRoute(target)
+                traceErr = retryFlowID(cmd, &traceOpts, func() (err error) {
+                    r.Trace, err = traceroute.Trace(ctx, target, traceOpts)
+                    return err
+                })
+                if cycles, _ := cmd.Flags().GetInt("mtr-cycles"); cycles > 0 {
+                    o := traceroute.MTROptions{Options: traceOpts, Cycles: cycles}
+                    mtrErr = retryFlowID(cmd, &o.Options, func() (err error) {
+                        r.MTR, err = traceroute.MTR(ctx, target, o)
+                        return err
+                    })
+                }
             }()
 
             go func() {
                 defer wg.Done()
-                uploadResult, uploadErr := bandwidth.MeasureUploadBandwidth(target)
-                if uploadErr != nil {
-                    bandwidthErr = uploadErr
+                r.Upload, bandwidthErr = bandwidth.MeasureHTTPUploadBandwidth(ctx, target, "http", bandwidth.Options{})
+                if bandwidthErr != nil {
                     return
                 }
-                downloadResult, downloadErr := bandwidth.MeasureDownloadBandwidth(target, "http")
-                if downloadErr != nil {
-                    bandwidthErr = downloadErr
-                    return
-                }
-                bandwidthResult = fmt.Sprintf("%s\n%s", uploadResult, downloadResult)
+                r.Download, bandwidthErr = bandwidth.MeasureDownloadBandwidth(ctx, target, "http", bandwidth.Options{})
             }()
 
             go func() {
                 defer wg.Done()
-                latencyResult, latencyErr = latency.AnalyzeLatency(target, 10, 15*time.Second)
+                r.Latency, latencyErr = latency.AnalyzeLatency(target, ping.Options{Count: 10, Timeout: 15*time.Second, ICMP: opts})
             }()
 
             go func() {
                 defer wg.Done()
-                packetLossResult, packetLossErr = packetloss.DetectPacketLoss(target, 20, 25*time.Second)
+                r.PacketLoss, packetLossErr = packetloss.DetectPacketLoss(target, ping.Options{Count: 20, Timeout: 25*time.Second, ICMP: opts})
             }()
 
             wg.Wait()
 
-            if pingErr != nil || traceErr != nil || bandwidthErr != nil || latencyErr != nil || packetLossErr != nil {
-                color.Red("Error in generating report: pingErr=%v, traceErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v",
-                    pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr)
+            // The bufferbloat test loads the link itself, so it runs alone.
+            var bufferbloatErr error
+            if noBufferbloat, _ := cmd.Flags().GetBool("no-bufferbloat"); !noBufferbloat {
+                download, upload := bandwidthLoads(target, "http", false)
+                r.Bufferbloat, bufferbloatErr = bufferbloat.Run(ctx, target, bufferbloat.Options{
+                    Ping:      ping.Options{ICMP: opts},
+                    Bandwidth: bandwidth.Options{WarmUp: time.Second},
+                    Download:  download,
+                    Upload:    upload,
+                })
+            }
+
+            if pingErr != nil || traceErr != nil || mtrErr != nil || bandwidthErr != nil || latencyErr != nil || packetLossErr != nil || sweepErr != nil || bufferbloatErr != nil {
+                color.Red("Error in generating report: pingErr=%v, traceErr=%v, mtrErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v, sweepErr=%v, bufferbloatErr=%v",
+                    pingErr, traceErr, mtrErr, bandwidthErr, latencyErr, packetLossErr, sweepErr, bufferbloatErr)
                 return
             }
 
-            err := report.GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult)
+            err = report.GenerateReport(r)
             if err != nil {
                 color.Red("Report generation error: %v", err)
                 return
             }
             color.Green("Report generated successfully!")
         },
-    })
+    }
+    reportCmd.Flags().String("subnet", "", "Also sweep this CIDR range and include its host inventory")
+    reportCmd.Flags().Bool("no-bufferbloat", false, "Skip the latency under load test")
+    reportCmd.Flags().Int("mtr-cycles", 0, "Also probe every hop on the route this many times, mtr style, and include the table")
+    addSweepFlags(reportCmd)
+    addTraceFlags(reportCmd)
+    rootCmd.AddCommand(reportCmd)
 
     rootCmd.AddCommand(&cobra.Command{
         Use:   "interactive",
@@ -194,6 +667,11 @@ func main() {
             fmt.Print("Enter the target: ")
             target, _ := reader.ReadString('\n')
             target = strings.TrimSpace(target)
+            opts, err := icmpOptions(cmd)
+            if err != nil {
+                color.Red("%v", err)
+                return
+            }
 
             fmt.Print("Enter the test to run (ping, traceroute, bandwidth, latency, packetloss, report): ")
             test, _ := reader.ReadString('\n')
@@ -207,24 +685,24 @@ func main() {
                 if count == 0 {
                     count = 4
                 }
-                result, err := ping.Ping(target, count, 5*time.Second)
+                result, err := ping.Ping(context.Background(), target, ping.Options{Count: count, Timeout: 5*time.Second, ICMP: opts})
                 if err != nil {
                     color.Red("Ping error: %v", err)
                 } else {
                     color.Cyan("Ping Result:\n%s", result)
                 }
             case "traceroute":
-                result, err := traceroute.TraceRoute(target)
+                hops, err := traceroute.TraceRoute(target, opts)
                 if err != nil {
                     color.Red("Traceroute error: %v", err)
                 } else {
-                    color.Cyan("Traceroute Result:\n%s", result)
+                    color.Cyan("Traceroute Result:\n%s", traceroute.Format(hops))
                 }
             case "bandwidth":
                 fmt.Print("Enter the protocol (http or https): ")
                 protocol, _ := reader.ReadString('\n')
                 protocol = strings.TrimSpace(protocol)
-                result, err := bandwidth.MeasureDownloadBandwidth(target, protocol)
+                result, err := bandwidth.MeasureDownloadBandwidth(context.Background(), target, protocol, bandwidth.Options{})
                 if err != nil {
                     color.Red("Bandwidth measurement error: %v", err)
                 } else {
@@ -237,7 +715,7 @@ func main() {
                 if count == 0 {
                     count = 4
                 }
-                result, err := latency.AnalyzeLatency(target, count, 5*time.Second)
+                result, err := latency.AnalyzeLatency(target, ping.Options{Count: count, Timeout: 5*time.Second, ICMP: opts})
                 if err != nil {
                     color.Red("Latency analysis error: %v", err)
                 } else {
@@ -250,7 +728,7 @@ func main() {
                 if count == 0 {
                     count = 4
                 }
-                result, err := packetloss.DetectPacketLoss(target, count, 5*time.Second)
+                result, err := packetloss.DetectPacketLoss(target, ping.Options{Count: count, Timeout: 5*time.Second, ICMP: opts})
                 if err != nil {
                     color.Red("Packet loss detection error: %v", err)
                 } else {
@@ -260,32 +738,32 @@ func main() {
                 var wg sync.WaitGroup
                 wg.Add(5)
 
-                var pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult string
+                r := &report.Report{Target: target}
                 var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr error
 
                 go func() {
                     defer wg.Done()
-                    pingResult, pingErr = ping.Ping(target, 4, 5*time.Second)
+                    r.Ping, pingErr = ping.Ping(context.Background(), target, ping.Options{Count: 4, Timeout: 5*time.Second, ICMP: opts})
                 }()
 
                 go func() {
                     defer wg.Done()
-                    traceResult, traceErr = traceroute.TraceRoute(target)
+                    r.Trace, traceErr = traceroute.TraceRoute(target, opts)
                 }()
 
                 go func() {
                     defer wg.Done()
-                    bandwidthResult, bandwidthErr = bandwidth.MeasureUploadBandwidth(target)
+                    r.Upload, bandwidthErr = bandwidth.MeasureHTTPUploadBandwidth(context.Background(), target, "http", bandwidth.Options{})
                 }()
 
                 go func() {
                     defer wg.Done()
-                    latencyResult, latencyErr = latency.AnalyzeLatency(target, 10, 15*time.Second)
+                    r.Latency, latencyErr = latency.AnalyzeLatency(target, ping.Options{Count: 10, Timeout: 15*time.Second, ICMP: opts})
                 }()
 
                 go func() {
                     defer wg.Done()
-                    packetLossResult, packetLossErr = packetloss.DetectPacketLoss(target, 20, 25*time.Second)
+                    r.PacketLoss, packetLossErr = packetloss.DetectPacketLoss(target, ping.Options{Count: 20, Timeout: 25*time.Second, ICMP: opts})
                 }()
 
                 wg.Wait()
@@ -294,7 +772,7 @@ func main() {
                     color.Red("Error in generating report: pingErr=%v, traceErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v",
                         pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr)
                 } else {
-                    err := report.GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult)
+                    err := report.GenerateReport(r)
                     if err != nil {
                         color.Red("Report generation error: %v", err)
                     } else {
@@ -318,3 +796,320 @@ func main() {
         color.Red("CLI error: %v", err)
     }
 }
+
+// runProbeTests runs the upload, download and UDP tests against a
+// serve-probe server and prints their results.
+func runProbeTests(target string, o bandwidth.Options) {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    uploadResult, err := bandwidth.ProbeUpload(ctx, target, o)
+    if err != nil {
+        color.Red("Upload Bandwidth measurement error: %v", err)
+        return
+    }
+    color.Cyan("Upload Bandwidth Result:\n%s", uploadResult)
+
+    downloadResult, err := bandwidth.ProbeDownload(ctx, target, o)
+    if err != nil {
+        color.Red("Download Bandwidth measurement error: %v", err)
+        return
+    }
+    color.Cyan("Download Bandwidth Result:\n%s", downloadResult)
+
+    udpResult, err := bandwidth.ProbeUDP(ctx, target, bandwidth.UDPOptions{
+        Count:    100,
+        Interval: 20 * time.Millisecond,
+        Size:     512,
+        Wait:     time.Second,
+    })
+    if err != nil {
+        color.Red("UDP test error: %v", err)
+        return
+    }
+    color.Cyan("UDP Test Result:\n%s", udpResult)
+}
+
+// runUDPThroughputTest runs a UDP throughput test against a serve-probe
+// server and prints its result.
+func runUDPThroughputTest(target string, o bandwidth.Options) {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    result, err := bandwidth.ProbeUDPThroughput(ctx, target, o)
+    if err != nil {
+        color.Red("UDP throughput test error: %v", err)
+        return
+    }
+    color.Cyan("UDP Throughput Result:\n%s", result)
+}
+
+// runIperf3Tests runs an upload and a reverse, download test against an
+// iperf3 server and prints their results.
+func runIperf3Tests(target string, o bandwidth.Options) {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    uploadResult, err := bandwidth.MeasureIperf3(ctx, target, "upload", o)
+    if err != nil {
+        color.Red("Upload Bandwidth measurement error: %v", err)
+        return
+    }
+    color.Cyan("Upload Bandwidth Result:\n%s", uploadResult)
+
+    downloadResult, err := bandwidth.MeasureIperf3(ctx, target, "download", o)
+    if err != nil {
+        color.Red("Download Bandwidth measurement error: %v", err)
+        return
+    }
+    color.Cyan("Download Bandwidth Result:\n%s", downloadResult)
+}
+
+// bandwidthLoads returns the download and upload tests the bandwidth command
+// would run against target, for loading the link in each direction.
+func bandwidthLoads(target, protocol string, iperf3 bool) (download, upload bufferbloat.Load) {
+    switch {
+    case iperf3:
+        iperf := func(direction string) bufferbloat.Load {
+            return func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error) {
+                r, err := bandwidth.MeasureIperf3(ctx, target, direction, o)
+                if err != nil {
+                    return nil, err
+                }
+                return r.Measurement, nil
+            }
+        }
+        download, upload = iperf("download"), iperf("upload")
+    case protocol == "probe":
+        download = func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error) {
+            return bandwidth.ProbeDownload(ctx, target, o)
+        }
+        upload = func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error) {
+            return bandwidth.ProbeUpload(ctx, target, o)
+        }
+    default:
+        download = func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error) {
+            return bandwidth.MeasureDownloadBandwidth(ctx, target, protocol, o)
+        }
+        upload = func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error) {
+            return bandwidth.MeasureHTTPUploadBandwidth(ctx, target, protocol, o)
+        }
+    }
+    return download, upload
+}
+
+// bandwidthOptions builds the bandwidth test options from the bandwidth
+// command's flags. Periodic reports are printed as they come in.
+func bandwidthOptions(cmd *cobra.Command) (bandwidth.Options, error) {
+    duration, _ := cmd.Flags().GetDuration("duration")
+    parallel, _ := cmd.Flags().GetInt("parallel")
+    interval, _ := cmd.Flags().GetDuration("interval")
+    warmup, _ := cmd.Flags().GetDuration("warmup")
+    udp, _ := cmd.Flags().GetBool("udp")
+    rateFlag, _ := cmd.Flags().GetString("rate")
+    sizeFlag, _ := cmd.Flags().GetString("upload-size")
+    method, _ := cmd.Flags().GetString("upload-method")
+
+    rate, err := bandwidth.ParseBitrate(rateFlag)
+    if err != nil {
+        return bandwidth.Options{}, err
+    }
+    size, err := bandwidth.ParseSize(sizeFlag)
+    if err != nil {
+        return bandwidth.Options{}, err
+    }
+
+    o := bandwidth.Options{Duration: duration, Parallel: parallel, Interval: interval, WarmUp: warmup, UDP: udp, Rate: rate,
+        UploadSize: size, UploadMethod: strings.ToUpper(method)}
+    if interval > 0 {
+        o.OnInterval = func(i bandwidth.Interval) {
+            if i.Start == 0 {
+                fmt.Println("  Interval            Transfer  Bitrate")
+            }
+            fmt.Println(i)
+        }
+        o.OnUDPInterval = func(i bandwidth.UDPInterval) {
+            if i.Start == 0 {
+                fmt.Println("  Interval            Transfer        Bitrate       Jitter    Lost/Total         Out of order")
+            }
+            fmt.Println(i)
+        }
+    }
+    return o, nil
+}
+
+// printPingMany prints the per-target table followed by which targets
+// answered and which didn't.
+func printPingMany(results []*ping.PingStats) {
+    fmt.Print(ping.FormatTable(results))
+
+    var alive, unreachable []string
+    for _, r := range results {
+        if r.Alive() {
+            alive = append(alive, r.Target)
+        } else {
+            unreachable = append(unreachable, r.Target)
+        }
+    }
+    color.Green("Alive (%d): %s", len(alive), strings.Join(alive, " "))
+    color.Red("Unreachable (%d): %s", len(unreachable), strings.Join(unreachable, " "))
+}
+
+// addProtoFlags registers the probe protocol flags of ping, latency and
+// packetloss.
+func addProtoFlags(cmd *cobra.Command) {
+    cmd.Flags().String("proto", "icmp", "Probe protocol: icmp, tcp to time TCP handshakes, or udp to probe a gonetdiag reflect server")
+    cmd.Flags().Int("port", 443, fmt.Sprintf("Port for --proto tcp or udp (udp uses %d unless set)", ping.ReflectPort))
+}
+
+// pingOptions builds the probe options from the count, timeout and protocol
+// flags.
+func pingOptions(cmd *cobra.Command, opts icmp.Options) (ping.Options, error) {
+    count, _ := cmd.Flags().GetInt("count")
+    timeout, _ := cmd.Flags().GetDuration("timeout")
+    proto, _ := cmd.Flags().GetString("proto")
+    port, _ := cmd.Flags().GetInt("port")
+    if proto == "udp" && !cmd.Flags().Changed("port") {
+        port = ping.ReflectPort
+    }
+
+    o := ping.Options{Count: count, Timeout: timeout, ICMP: opts, Proto: proto, Port: port}
+    return o, o.Validate()
+}
+
+// addSweepFlags registers the flags shared by sweep and report --subnet.
+func addSweepFlags(cmd *cobra.Command) {
+    cmd.Flags().Int("concurrency", 64, "Maximum number of hosts to probe at once")
+    cmd.Flags().Int("rate", 100, "Maximum pings per second across the sweep")
+    cmd.Flags().Bool("tcp", false, "Try TCP connects to common ports on hosts that don't answer ICMP")
+    cmd.Flags().IntSlice("tcp-ports", nil, "Ports for the TCP fallback (implies --tcp)")
+    cmd.Flags().Bool("no-dns", false, "Don't look up host names of responders")
+}
+
+// sweepOptions builds the sweep options from the flags added by addSweepFlags.
+func sweepOptions(cmd *cobra.Command, opts icmp.Options) (sweep.Options, error) {
+    timeout, _ := cmd.Flags().GetDuration("timeout")
+    concurrency, _ := cmd.Flags().GetInt("concurrency")
+    rate, _ := cmd.Flags().GetInt("rate")
+    tcp, _ := cmd.Flags().GetBool("tcp")
+    ports, _ := cmd.Flags().GetIntSlice("tcp-ports")
+    noDNS, _ := cmd.Flags().GetBool("no-dns")
+
+    if tcp && len(ports) == 0 {
+        ports = sweep.CommonPorts
+    }
+    for _, port := range ports {
+        if port <= 0 || port > 65535 {
+            return sweep.Options{}, fmt.Errorf("invalid TCP port: %d", port)
+        }
+    }
+
+    return sweep.Options{
+        Count:       1,
+        Timeout:     timeout,
+        Concurrency: concurrency,
+        Rate:        rate,
+        ICMP:        opts,
+        TCPPorts:    ports,
+        NoDNS:       noDNS,
+    }, nil
+}
+
+// addTraceFlags registers the probe flags shared by traceroute, mtr and
+// report.
+func addTraceFlags(cmd *cobra.Command) {
+    cmd.Flags().String("method", traceroute.MethodICMP, "Probe method: icmp echo, udp to high ports, or tcp SYNs to --port")
+    cmd.Flags().Int("port", 0, fmt.Sprintf("Destination port for --method tcp (default %d), or the first for udp (default %d)", traceroute.DefaultTCPPort, traceroute.DefaultUDPPort))
+    cmd.Flags().Int("flow-id", 0, "ICMP identifier, or UDP and TCP source port, shared by every probe to pin one load-balanced path (random if not set)")
+    cmd.Flags().Int("first-ttl", 1, "TTL of the first hop to probe")
+    cmd.Flags().Int("max-hops", traceroute.DefaultMaxHops, "TTL of the last hop to probe")
+    cmd.Flags().Duration("wait", traceroute.DefaultWait, fmt.Sprintf("Time to wait for each probe's answer, up to %v", traceroute.MaxWait))
+    cmd.Flags().Int("size", 0, "Payload bytes each probe carries after its ICMP, UDP or TCP header")
+    cmd.Flags().String("source", "", "Local address to send probes from")
+    cmd.Flags().String("interface", "", "Send probes from this interface's address")
+    cmd.Flags().Int("tos", 0, "IPv4 type of service or IPv6 traffic class of probes")
+    // report already has --no-dns for its subnet sweep, and it means the
+    // same thing here.
+    if cmd.Flags().Lookup("no-dns") == nil {
+        cmd.Flags().Bool("no-dns", false, "Don't look up host names of routers")
+    }
+}
+
+// traceOptions builds the trace options from the flags added by
+// addTraceFlags. A flow ID is picked here when none is given, so it can be
+// shown and the same path traced again with it.
+func traceOptions(cmd *cobra.Command) (traceroute.Options, error) {
+    opts, err := icmpOptions(cmd)
+    if err != nil {
+        return traceroute.Options{}, err
+    }
+    o := traceroute.Options{ICMP: opts}
+    o.Method, _ = cmd.Flags().GetString("method")
+    o.Port, _ = cmd.Flags().GetInt("port")
+    o.FlowID, _ = cmd.Flags().GetInt("flow-id")
+    o.FirstTTL, _ = cmd.Flags().GetInt("first-ttl")
+    o.MaxHops, _ = cmd.Flags().GetInt("max-hops")
+    o.Wait, _ = cmd.Flags().GetDuration("wait")
+    o.Size, _ = cmd.Flags().GetInt("size")
+    o.Source, _ = cmd.Flags().GetString("source")
+    o.Interface, _ = cmd.Flags().GetString("interface")
+    o.TOS, _ = cmd.Flags().GetInt("tos")
+    o.NoDNS, _ = cmd.Flags().GetBool("no-dns")
+    if o.FirstTTL < 1 || o.MaxHops < 1 {
+        return o, fmt.Errorf("--first-ttl and --max-hops must be at least 1")
+    }
+    if o.Wait <= 0 {
+        return o, fmt.Errorf("--wait must be positive")
+    }
+    switch o.Method {
+    case traceroute.MethodICMP, traceroute.MethodUDP, traceroute.MethodTCP:
+    default:
+        return o, fmt.Errorf("--method must be icmp, udp or tcp")
+    }
+    if o.Port < 0 || o.Port > 0xffff {
+        return o, fmt.Errorf("--port must be between 1 and 65535")
+    }
+    if o.FlowID < 0 || o.FlowID > 0xffff {
+        return o, fmt.Errorf("--flow-id must be between 1 and 65535")
+    }
+    if o.FlowID == 0 {
+        o.FlowID = randomFlowID()
+    }
+    return o, nil
+}
+
+// randomFlowID picks a flow ID from the usual ephemeral port range, as it may
+// be a source port.
+func randomFlowID() int {
+    return 32768 + rand.IntN(28232)
+}
+
+// retryFlowID calls run, and while it fails because the flow ID picked for
+// it is a UDP source port already in use, picks another and calls it again.
+// A flow ID given with --flow-id is never changed.
+func retryFlowID(cmd *cobra.Command, o *traceroute.Options, run func() error) error {
+    err := run()
+    for tries := 1; tries < 5 && errors.Is(err, syscall.EADDRINUSE) && !cmd.Flags().Changed("flow-id"); tries++ {
+        o.FlowID = randomFlowID()
+        err = run()
+    }
+    return err
+}
+
+// icmpOptions builds the ICMP probe options from the global flags.
+func icmpOptions(cmd *cobra.Command) (icmp.Options, error) {
+    ipv4, _ := cmd.Flags().GetBool("ipv4")
+    ipv6, _ := cmd.Flags().GetBool("ipv6")
+    privileged, _ := cmd.Flags().GetBool("privileged")
+
+    opts := icmp.Options{Privileged: privileged}
+    switch {
+    case ipv4 && ipv6:
+        return opts, fmt.Errorf("--ipv4 and --ipv6 are mutually exclusive")
+    case ipv4:
+        opts.Network = "ip4"
+    case ipv6:
+        opts.Network = "ip6"
+    }
+    return opts, nil
+}
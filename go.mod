@@ -37,5 +37,5 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/spf13/cobra v1.8.1
 	golang.org/x/net v0.27.0
-	golang.org/x/sys v0.22.0 // indirect
+	golang.org/x/sys v0.22.0
 )
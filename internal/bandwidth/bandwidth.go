@@ -1,74 +1,237 @@
 package bandwidth
 
 import (
+    "context"
     "fmt"
     "io"
-    "net"
     "net/http"
     "strings"
+    "sync/atomic"
     "time"
 )
 
-func MeasureUploadBandwidth(target string) (string, error) {
-    if !strings.Contains(target, ":") {
-        target = fmt.Sprintf("%s:80", target) // Default to port 80 if no port is specified
-    }
-
-    conn, err := net.DialTimeout("tcp", target, 5*time.Second)
-    if err != nil {
-        return "", fmt.Errorf("failed to dial target: %w", err)
-    }
-    defer conn.Close()
+// Measurement is the outcome of a bandwidth test in one direction. Bytes and
+// Duration cover all streams after the warm-up.
+type Measurement struct {
+    Target    string         `json:"target"`
+    Direction string         `json:"direction"`
+    Bytes     int64          `json:"bytes"`
+    Duration  time.Duration  `json:"duration"`
+    Streams   []StreamResult `json:"streams,omitempty"`
+    Intervals []Interval     `json:"intervals,omitempty"`
+}
 
-    start := time.Now()
-    data := make([]byte, 1024)
-    var totalBytes int
+// BitsPerSecond returns the measured throughput.
+func (m *Measurement) BitsPerSecond() float64 {
+    return bitsPerSecond(m.Bytes, m.Duration)
+}
 
-    for time.Since(start) < time.Second {
-        n, err := conn.Write(data)
-        if err != nil {
-            return "", err
+func (m *Measurement) String() string {
+    var sb strings.Builder
+    if m.Direction == "upload" {
+        fmt.Fprintf(&sb, "Measured upload bandwidth to %s: %s", m.Target, FormatBitrate(m.BitsPerSecond()))
+    } else {
+        fmt.Fprintf(&sb, "Measured download bandwidth from %s: %s", m.Target, FormatBitrate(m.BitsPerSecond()))
+    }
+    fmt.Fprintf(&sb, " (%s in %.2f s)", FormatBytes(m.Bytes), m.Duration.Seconds())
+    if len(m.Streams) == 1 {
+        s := m.Streams[0]
+        if s.HTTP != nil {
+            fmt.Fprintf(&sb, "\n%s", s.HTTP)
+        }
+        if n := len(s.TCPInfo); n > 0 {
+            fmt.Fprintf(&sb, "\nTCP: %s", s.TCPInfo[n-1])
         }
-        totalBytes += n
     }
-
-    bandwidth := float64(totalBytes) / time.Since(start).Seconds() / 1024 / 1024
-    return fmt.Sprintf("Measured upload bandwidth to %s: %.2f Mbps", target, bandwidth), nil
+    if len(m.Streams) > 1 {
+        for i, s := range m.Streams {
+            fmt.Fprintf(&sb, "\n  stream %d: %s (%s in %.2f s)", i+1, FormatBitrate(s.BitsPerSecond()), FormatBytes(s.Bytes), s.Duration.Seconds())
+            if s.HTTP != nil {
+                fmt.Fprintf(&sb, ", first byte after %.3f ms", float64(s.HTTP.FirstByte)/float64(time.Millisecond))
+            }
+            if n := len(s.TCPInfo); n > 0 {
+                fmt.Fprintf(&sb, "\n    TCP: %s", s.TCPInfo[n-1])
+            }
+        }
+    }
+    return sb.String()
 }
 
-func MeasureDownloadBandwidth(target, protocol string) (string, error) {
+// MeasureDownloadBandwidth fetches target over HTTP(S), once per stream, and
+// measures how fast the bodies arrive. Each fetch stops when its body ends or
+// the duration in o is up, whichever is first, or when ctx is done. Each
+// stream's result breaks its request down into phases, with the transfer
+// running until it stopped.
+func MeasureDownloadBandwidth(ctx context.Context, target, protocol string, o Options) (*Measurement, error) {
     if protocol != "http" && protocol != "https" {
-        return "", fmt.Errorf("invalid protocol specified: %s", protocol)
+        return nil, fmt.Errorf("invalid protocol specified: %s", protocol)
     }
 
     if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
         target = fmt.Sprintf("%s://%s", protocol, target)
     }
 
-    client := &http.Client{
-        Timeout: 10 * time.Second,
+    return measure(ctx, target, "download", o, openEach(func() (*stream, error) {
+        ctx, cancel := context.WithCancel(ctx)
+        tracer, ctx := newHTTPTracer(ctx)
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+        if err != nil {
+            cancel()
+            return nil, fmt.Errorf("failed to create GET request: %w", err)
+        }
+        timer := time.AfterFunc(10*time.Second, cancel)
+        resp, err := http.DefaultClient.Do(req)
+        timer.Stop()
+        if err != nil {
+            cancel()
+            return nil, fmt.Errorf("failed to perform GET request: %w", err)
+        }
+        buffer := make([]byte, 32*1024)
+        var read int64
+        var last time.Time
+        return &stream{
+            step: func() (int, error) {
+                n, err := resp.Body.Read(buffer)
+                read += int64(n)
+                last = time.Now()
+                return n, err
+            },
+            stop:   cancel,
+            timing: func() *HTTPTiming { return tracer.timing(resp, read, last) },
+            conn:   tracer.conn,
+            close: func() error {
+                cancel()
+                return resp.Body.Close()
+            },
+        }, nil
+    }))
+}
+
+// MeasureHTTPUploadBandwidth streams a generated body to target over
+// HTTP(S), once per stream, with a chunked o.UploadMethod request, and
+// measures how fast it goes out. Each body ends after o.UploadSize bytes or
+// when the duration in o is up, whichever is first, or when ctx is done,
+// and the stream then
+// waits for the server to answer; the time that takes is its timing's
+// server processing time. Any endpoint that accepts and discards uploads
+// will do.
+func MeasureHTTPUploadBandwidth(ctx context.Context, target, protocol string, o Options) (*Measurement, error) {
+    if protocol != "http" && protocol != "https" {
+        return nil, fmt.Errorf("invalid protocol specified: %s", protocol)
+    }
+    method := o.UploadMethod
+    if method == "" {
+        method = http.MethodPost
+    }
+    if method != http.MethodPost && method != http.MethodPut {
+        return nil, fmt.Errorf("invalid upload method: %s", method)
     }
 
-    start := time.Now()
-    resp, err := client.Get(target)
-    if err != nil {
-        return "", fmt.Errorf("failed to perform GET request: %w", err)
+    if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+        target = fmt.Sprintf("%s://%s", protocol, target)
     }
-    defer resp.Body.Close()
 
-    var totalBytes int
-    buffer := make([]byte, 32*1024)
-    for {
-        n, err := resp.Body.Read(buffer)
-        totalBytes += n
+    return measure(ctx, target, "upload", o, openEach(func() (*stream, error) {
+        ctx, cancel := context.WithCancel(ctx)
+        tracer, ctx := newHTTPTracer(ctx)
+        body, pw := io.Pipe()
+        req, err := http.NewRequestWithContext(ctx, method, target, body)
         if err != nil {
-            if err == io.EOF {
-                break
+            cancel()
+            return nil, fmt.Errorf("failed to create %s request: %w", method, err)
+        }
+        req.ContentLength = -1 // chunked
+        req.Header.Set("Content-Type", "application/octet-stream")
+
+        type answer struct {
+            resp  *http.Response
+            read  int64
+            ended time.Time
+            err   error
+        }
+        answered := make(chan answer, 1)
+        go func() {
+            resp, err := http.DefaultClient.Do(req)
+            if err != nil {
+                answered <- answer{err: fmt.Errorf("failed to perform %s request: %w", method, err)}
+                return
+            }
+            n, _ := io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+            answered <- answer{resp: resp, read: n, ended: time.Now()}
+        }()
+
+        // check waits for the server's answer, which must be a success.
+        var a *answer
+        check := func() error {
+            if a == nil {
+                timer := time.AfterFunc(10*time.Second, cancel)
+                got := <-answered
+                timer.Stop()
+                a = &got
+            }
+            if a.err != nil {
+                return a.err
             }
-            return "", fmt.Errorf("error while reading response body: %w", err)
+            if a.resp.StatusCode < 200 || a.resp.StatusCode > 299 {
+                return fmt.Errorf("server answered %s", a.resp.Status)
+            }
+            return nil
         }
-    }
 
-    bandwidth := float64(totalBytes) / time.Since(start).Seconds() / 1024 / 1024
-    return fmt.Sprintf("Measured download bandwidth from %s: %.2f Mbps", target, bandwidth), nil
+        buf := make([]byte, 128*1024)
+        var sent int64
+        var stopped atomic.Bool
+        return &stream{
+            step: func() (int, error) {
+                chunk := buf
+                if o.UploadSize > 0 {
+                    if left := o.UploadSize - sent; left < int64(len(chunk)) {
+                        chunk = chunk[:left]
+                    }
+                    if len(chunk) == 0 {
+                        pw.Close()
+                        return 0, io.EOF
+                    }
+                }
+                n, err := pw.Write(chunk)
+                sent += int64(n)
+                if err != nil {
+                    if stopped.Load() {
+                        return n, io.EOF
+                    }
+                    // The server stopped reading the body, most likely to
+                    // answer early with an error.
+                    if err := check(); err != nil {
+                        return n, err
+                    }
+                    return n, io.EOF
+                }
+                return n, nil
+            },
+            // Ending the body, rather than the request, lets the server
+            // answer.
+            stop: func() {
+                stopped.Store(true)
+                pw.Close()
+            },
+            finish: func() error {
+                pw.Close()
+                return check()
+            },
+            conn: tracer.conn,
+            timing: func() *HTTPTiming {
+                if a == nil || a.resp == nil {
+                    return nil
+                }
+                t := tracer.timing(a.resp, a.read, a.ended)
+                t.Sent = sent
+                return t
+            },
+            close: func() error {
+                cancel()
+                return pw.Close()
+            },
+        }, nil
+    }))
 }
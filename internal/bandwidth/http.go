@@ -0,0 +1,240 @@
+package bandwidth
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptrace"
+    "strings"
+    "sync"
+    "time"
+)
+
+// HTTPTiming breaks an HTTP request down into its phases, as curl -w does.
+// After a redirect the phases are those of the last request, while
+// FirstByte and Total run from the start of the first.
+type HTTPTiming struct {
+    URL        string `json:"url"`
+    RemoteAddr string `json:"remote_addr"`
+    Status     string `json:"status"`
+    StatusCode int    `json:"status_code"`
+    Proto      string `json:"proto"`
+
+    // TLSVersion and TLSCipher are empty over plain HTTP.
+    TLSVersion string `json:"tls_version,omitempty"`
+    TLSCipher  string `json:"tls_cipher,omitempty"`
+
+    // Reused is set when the request went over a kept-alive connection, so
+    // there was no DNS lookup, connect or handshake.
+    Reused bool `json:"reused"`
+
+    // Bytes is the size of the response body that was read, and Sent that
+    // of the request body of an upload.
+    Bytes int64 `json:"bytes"`
+    Sent  int64 `json:"sent,omitempty"`
+
+    DNS      time.Duration `json:"dns"`
+    Connect  time.Duration `json:"connect"`
+    TLS      time.Duration `json:"tls"`
+    Wait     time.Duration `json:"wait"` // from sending the request to the first response byte
+    Transfer time.Duration `json:"transfer"`
+
+    FirstByte time.Duration `json:"first_byte"`
+    Total     time.Duration `json:"total"`
+}
+
+func (t *HTTPTiming) String() string {
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "%s %s from %s", t.Proto, t.Status, t.RemoteAddr)
+    if t.TLSVersion != "" {
+        fmt.Fprintf(&sb, ", %s %s", t.TLSVersion, t.TLSCipher)
+    }
+    if t.Reused {
+        sb.WriteString(", reused connection")
+    }
+    if t.Sent > 0 {
+        fmt.Fprintf(&sb, ", sent %s", FormatBytes(t.Sent))
+    }
+    fmt.Fprintf(&sb, ", %s", FormatBytes(t.Bytes))
+    ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+    fmt.Fprintf(&sb, "\nDNS lookup:        %9.3f ms", ms(t.DNS))
+    fmt.Fprintf(&sb, "\nTCP connect:       %9.3f ms", ms(t.Connect))
+    fmt.Fprintf(&sb, "\nTLS handshake:     %9.3f ms", ms(t.TLS))
+    fmt.Fprintf(&sb, "\nServer processing: %9.3f ms", ms(t.Wait))
+    fmt.Fprintf(&sb, "\nContent transfer:  %9.3f ms", ms(t.Transfer))
+    fmt.Fprintf(&sb, "\nTime to first byte:%9.3f ms", ms(t.FirstByte))
+    fmt.Fprintf(&sb, "\nTotal:             %9.3f ms", ms(t.Total))
+    return sb.String()
+}
+
+// httpTracer records when each phase of an HTTP request starts and ends.
+type httpTracer struct {
+    mu           sync.Mutex
+    start        time.Time
+    dnsStart     time.Time
+    dnsDone      time.Time
+    connectStart time.Time
+    connectDone  time.Time
+    tlsStart     time.Time
+    tlsDone      time.Time
+    wroteRequest time.Time
+    firstByte    time.Time
+    reused       bool
+    remoteAddr   string
+    netConn      net.Conn
+}
+
+// newHTTPTracer returns a tracer whose clock starts now, and ctx with it
+// attached.
+func newHTTPTracer(ctx context.Context) (*httpTracer, context.Context) {
+    t := &httpTracer{start: time.Now()}
+    now := func(at *time.Time) {
+        t.mu.Lock()
+        *at = time.Now()
+        t.mu.Unlock()
+    }
+    trace := &httptrace.ClientTrace{
+        DNSStart: func(httptrace.DNSStartInfo) {
+            // A redirect to another host starts over with a new connection.
+            t.mu.Lock()
+            t.dnsStart, t.dnsDone = time.Now(), time.Time{}
+            t.connectStart, t.connectDone = time.Time{}, time.Time{}
+            t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+            t.mu.Unlock()
+        },
+        DNSDone: func(httptrace.DNSDoneInfo) { now(&t.dnsDone) },
+        ConnectStart: func(network, addr string) {
+            // Dialing both address families at once starts several
+            // connects; the first to start and the one that wins count.
+            t.mu.Lock()
+            if t.connectStart.IsZero() || !t.connectDone.IsZero() {
+                t.connectStart = time.Now()
+            }
+            t.mu.Unlock()
+        },
+        ConnectDone: func(network, addr string, err error) {
+            if err == nil {
+                now(&t.connectDone)
+            }
+        },
+        TLSHandshakeStart: func() { now(&t.tlsStart) },
+        TLSHandshakeDone:  func(tls.ConnectionState, error) { now(&t.tlsDone) },
+        GotConn: func(info httptrace.GotConnInfo) {
+            t.mu.Lock()
+            t.reused = info.Reused
+            t.remoteAddr = info.Conn.RemoteAddr().String()
+            t.netConn = info.Conn
+            if info.Reused {
+                t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+                t.connectStart, t.connectDone = time.Time{}, time.Time{}
+                t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+            }
+            t.mu.Unlock()
+        },
+        WroteRequest:         func(httptrace.WroteRequestInfo) { now(&t.wroteRequest) },
+        GotFirstResponseByte: func() { now(&t.firstByte) },
+    }
+    return t, httptrace.WithClientTrace(ctx, trace)
+}
+
+// conn returns the connection the request went over, or nil if it hasn't
+// got one yet.
+func (t *httpTracer) conn() net.Conn {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.netConn
+}
+
+// timing returns the phases of the request that got resp, whose body had
+// bytes read from it by end.
+func (t *httpTracer) timing(resp *http.Response, bytes int64, end time.Time) *HTTPTiming {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    span := func(from, to time.Time) time.Duration {
+        if from.IsZero() || to.Before(from) {
+            return 0
+        }
+        return to.Sub(from)
+    }
+    h := &HTTPTiming{
+        URL:        resp.Request.URL.String(),
+        RemoteAddr: t.remoteAddr,
+        Status:     resp.Status,
+        StatusCode: resp.StatusCode,
+        Proto:      resp.Proto,
+        Reused:     t.reused,
+        Bytes:      bytes,
+        DNS:        span(t.dnsStart, t.dnsDone),
+        Connect:    span(t.connectStart, t.connectDone),
+        TLS:        span(t.tlsStart, t.tlsDone),
+        Wait:       span(t.wroteRequest, t.firstByte),
+        Transfer:   span(t.firstByte, end),
+        FirstByte:  span(t.start, t.firstByte),
+        Total:      span(t.start, end),
+    }
+    if resp.TLS != nil {
+        h.TLSVersion = tls.VersionName(resp.TLS.Version)
+        h.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+    }
+    return h
+}
+
+// HTTPOptions controls TimeHTTP.
+type HTTPOptions struct {
+    // Timeout bounds the whole request, body included. Zero means 30
+    // seconds.
+    Timeout time.Duration
+
+    // FollowRedirects follows redirects rather than timing the redirect
+    // response itself.
+    FollowRedirects bool
+
+    // Insecure skips verifying the server's certificate.
+    Insecure bool
+}
+
+// TimeHTTP fetches url with a fresh connection, reads the whole body and
+// reports how long each phase took. url defaults to https if it has no
+// scheme.
+func TimeHTTP(ctx context.Context, url string, o HTTPOptions) (*HTTPTiming, error) {
+    if !strings.Contains(url, "://") {
+        url = "https://" + url
+    }
+    if o.Timeout <= 0 {
+        o.Timeout = 30 * time.Second
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    if o.Insecure {
+        transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+    }
+    defer transport.CloseIdleConnections()
+    client := &http.Client{Transport: transport}
+    if !o.FollowRedirects {
+        client.CheckRedirect = func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+    defer cancel()
+    tracer, ctx := newHTTPTracer(ctx)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create GET request: %w", err)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("failed to perform GET request: %w", err)
+    }
+    defer resp.Body.Close()
+
+    n, err := io.Copy(io.Discard, resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read response body: %w", err)
+    }
+    return tracer.timing(resp, n, time.Now()), nil
+}
@@ -0,0 +1,682 @@
+package bandwidth
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Iperf3Port is the port iperf3 servers listen on by default.
+const Iperf3Port = 5201
+
+// States of the iperf3 control protocol, sent as single signed bytes.
+const (
+    iperfTestStart       = 1
+    iperfTestRunning     = 2
+    iperfTestEnd         = 4
+    iperfParamExchange   = 9
+    iperfCreateStreams   = 10
+    iperfServerTerminate = 11
+    iperfClientTerminate = 12
+    iperfExchangeResults = 13
+    iperfDisplayResults  = 14
+    iperfDone            = 16
+    iperfAccessDenied    = -1
+    iperfServerError     = -2
+)
+
+const (
+    iperfCookieSize = 37 // 36 characters and a NUL
+    iperfTCPLen     = 128 * 1024
+    iperfUDPLen     = 1460
+
+    // A new UDP stream announces itself with this datagram and the server
+    // answers with the reply. Both are 32-bit integers that iperf3 writes
+    // in host byte order, so either order is accepted.
+    iperfUDPConnect      = 0x36373839
+    iperfUDPReply        = 0x39383736
+    iperfUDPLegacyReply  = 987654321
+    iperfUDPHeaderLength = 12 // seconds, microseconds, packet count
+
+    // DefaultUDPRate is the UDP send rate, in bits per second per stream,
+    // when Options doesn't give one. It matches iperf3's.
+    DefaultUDPRate = 1e6
+)
+
+// Iperf3Stream is one stream of an iperf3 test, combining what each end
+// knows: retransmits come from the sender, and jitter and loss from the
+// receiver.
+type Iperf3Stream struct {
+    ID       int   `json:"id"`
+    Sent     int64 `json:"sent"`
+    Received int64 `json:"received"`
+
+    // Retransmits is -1 when the sender couldn't count them.
+    Retransmits int `json:"retransmits"`
+
+    // UDP only.
+    Jitter  time.Duration `json:"jitter,omitempty"`
+    Lost    int           `json:"lost,omitempty"`
+    Packets int           `json:"packets,omitempty"`
+}
+
+// Iperf3Result is the outcome of a test against an iperf3 server. The
+// embedded Measurement is the throughput seen by this end.
+type Iperf3Result struct {
+    *Measurement
+    Protocol string         `json:"protocol"`
+    Streams  []Iperf3Stream `json:"iperf3_streams"`
+}
+
+// Retransmits returns the retransmits of all streams, or -1 if the sender
+// didn't count them.
+func (r *Iperf3Result) Retransmits() int {
+    total := 0
+    for _, s := range r.Streams {
+        if s.Retransmits < 0 {
+            return -1
+        }
+        total += s.Retransmits
+    }
+    return total
+}
+
+// Jitter returns the mean jitter of the streams.
+func (r *Iperf3Result) Jitter() time.Duration {
+    if len(r.Streams) == 0 {
+        return 0
+    }
+    var total time.Duration
+    for _, s := range r.Streams {
+        total += s.Jitter
+    }
+    return total / time.Duration(len(r.Streams))
+}
+
+// Loss returns the lost and total datagrams of all streams.
+func (r *Iperf3Result) Loss() (lost, packets int) {
+    for _, s := range r.Streams {
+        lost += s.Lost
+        packets += s.Packets
+    }
+    return lost, packets
+}
+
+func (r *Iperf3Result) String() string {
+    var sb strings.Builder
+    sb.WriteString(r.Measurement.String())
+
+    var received int64
+    for _, s := range r.Streams {
+        received += s.Received
+    }
+    fmt.Fprintf(&sb, "\nReceiver: %s", FormatBitrate(bitsPerSecond(received, r.Duration)))
+    if r.Protocol == "udp" {
+        lost, packets := r.Loss()
+        loss := 0.0
+        if packets > 0 {
+            loss = float64(lost) / float64(packets) * 100
+        }
+        fmt.Fprintf(&sb, ", Jitter = %.3fms, Lost = %d/%d (%.2f%%)",
+            float64(r.Jitter())/float64(time.Millisecond), lost, packets, loss)
+    } else if retransmits := r.Retransmits(); retransmits >= 0 {
+        fmt.Fprintf(&sb, ", Retransmits = %d", retransmits)
+    }
+    return sb.String()
+}
+
+// iperfParams are the test parameters a client sends an iperf3 server.
+type iperfParams struct {
+    TCP           bool   `json:"tcp,omitempty"`
+    UDP           bool   `json:"udp,omitempty"`
+    Omit          int    `json:"omit"`
+    Time          int    `json:"time"`
+    Parallel      int    `json:"parallel"`
+    Reverse       bool   `json:"reverse,omitempty"`
+    Len           int    `json:"len"`
+    Bandwidth     uint64 `json:"bandwidth,omitempty"`
+    PacingTimer   int    `json:"pacing_timer"`
+    ClientVersion string `json:"client_version"`
+}
+
+// iperfResults are what each end reports once the test is over.
+type iperfResults struct {
+    CPUUtilTotal         float64             `json:"cpu_util_total"`
+    CPUUtilUser          float64             `json:"cpu_util_user"`
+    CPUUtilSystem        float64             `json:"cpu_util_system"`
+    SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+    Streams              []iperfStreamResult `json:"streams"`
+}
+
+type iperfStreamResult struct {
+    ID          int     `json:"id"`
+    Bytes       int64   `json:"bytes"`
+    Retransmits int     `json:"retransmits"`
+    Jitter      float64 `json:"jitter"` // seconds
+    Errors      int     `json:"errors"`
+    Packets     int     `json:"packets"`
+    StartTime   float64 `json:"start_time"`
+    EndTime     float64 `json:"end_time"`
+}
+
+// iperfStream is this end's view of one data stream.
+type iperfStream struct {
+    id      int
+    counted time.Time // bytes before this belong to the warm-up
+    conn    net.Conn  // TCP only, to read retransmits from
+
+    mu          sync.Mutex
+    retransBase int  // retransmits during the warm-up, or -1
+    baselined   bool // whether retransBase has been read
+    bytes       int64
+    packets int // UDP datagrams sent, or the highest count received
+    omitted int // the highest count received during the warm-up
+    lost    int
+    jitter  float64 // seconds
+    transit float64 // seconds, of the last datagram received
+}
+
+func (s *iperfStream) add(n int) {
+    if time.Now().Before(s.counted) {
+        return
+    }
+    s.mu.Lock()
+    if !s.baselined {
+        s.retransBase = s.retransmits()
+        s.baselined = true
+    }
+    s.bytes += int64(n)
+    s.mu.Unlock()
+}
+
+// retransmits returns how many segments the stream's TCP connection has
+// retransmitted so far, or -1 if that can't be read here.
+func (s *iperfStream) retransmits() int {
+    if s.conn == nil {
+        return -1
+    }
+    info, ok := sampleTCPInfo(s.conn, 0)
+    if !ok {
+        return -1
+    }
+    return int(info.Retransmits)
+}
+
+// received accounts for a UDP datagram the way iperf3 does: gaps in the
+// packet count are losses, a count below the next expected one fills an
+// earlier gap, and jitter follows RFC 3550.
+func (s *iperfStream) received(b []byte, at time.Time) {
+    if len(b) < iperfUDPHeaderLength {
+        return
+    }
+    sec := binary.BigEndian.Uint32(b[0:])
+    usec := binary.BigEndian.Uint32(b[4:])
+    count := int(binary.BigEndian.Uint32(b[8:]))
+    sent := time.Unix(int64(sec), int64(usec)*1000)
+
+    // Datagrams of the warm-up only move the loss count's baseline.
+    warm := at.Before(s.counted)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if warm {
+        s.omitted = max(s.omitted, count)
+    } else {
+        s.bytes += int64(len(b))
+    }
+    switch {
+    case count > s.packets:
+        if !warm {
+            s.lost += count - max(s.packets, s.omitted) - 1
+        }
+        s.packets = count
+    case !warm && s.lost > 0:
+        s.lost--
+    }
+    transit := at.Sub(sent).Seconds()
+    if s.transit != 0 {
+        d := math.Abs(transit - s.transit)
+        s.jitter += (d - s.jitter) / 16
+    }
+    s.transit = transit
+}
+
+func (s *iperfStream) result(sender bool, elapsed time.Duration) iperfStreamResult {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r := iperfStreamResult{
+        ID:          s.id,
+        Bytes:       s.bytes,
+        Retransmits: -1,
+        Packets:     s.packets - s.omitted,
+        EndTime:     elapsed.Seconds(),
+    }
+    if sender {
+        // Retransmits of the warm-up don't count, as iperf3's own don't.
+        if now := s.retransmits(); now >= 0 && s.retransBase >= 0 {
+            r.Retransmits = now - s.retransBase
+        }
+    } else {
+        r.Jitter = s.jitter
+        r.Errors = s.lost
+    }
+    return r
+}
+
+// iperfControl is the control connection to an iperf3 server.
+type iperfControl struct {
+    conn   net.Conn
+    cookie []byte
+}
+
+func (c *iperfControl) readState() (int8, error) {
+    var b [1]byte
+    if _, err := io.ReadFull(c.conn, b[:]); err != nil {
+        return 0, fmt.Errorf("failed to read iperf3 state: %w", err)
+    }
+    state := int8(b[0])
+    switch state {
+    case iperfAccessDenied:
+        return 0, errors.New("iperf3 server denied access, it may be busy with another test")
+    case iperfServerError:
+        var codes [8]byte
+        io.ReadFull(c.conn, codes[:])
+        return 0, fmt.Errorf("iperf3 server error %d (errno %d)",
+            int32(binary.BigEndian.Uint32(codes[0:])), int32(binary.BigEndian.Uint32(codes[4:])))
+    case iperfServerTerminate:
+        return 0, errors.New("iperf3 server terminated the test")
+    }
+    return state, nil
+}
+
+// expect reads states until want, failing on anything iperf3 wouldn't send
+// before it.
+func (c *iperfControl) expect(want int8, allowed ...int8) error {
+    for {
+        state, err := c.readState()
+        if err != nil {
+            return err
+        }
+        if state == want {
+            return nil
+        }
+        ok := false
+        for _, a := range allowed {
+            ok = ok || state == a
+        }
+        if !ok {
+            return fmt.Errorf("unexpected iperf3 state %d while waiting for %d", state, want)
+        }
+    }
+}
+
+func (c *iperfControl) writeState(state int8) error {
+    _, err := c.conn.Write([]byte{byte(state)})
+    return err
+}
+
+// writeJSON and readJSON frame JSON with a 32-bit length, as iperf3 does.
+func (c *iperfControl) writeJSON(v interface{}) error {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    frame := make([]byte, 4+len(b))
+    binary.BigEndian.PutUint32(frame, uint32(len(b)))
+    copy(frame[4:], b)
+    _, err = c.conn.Write(frame)
+    return err
+}
+
+func (c *iperfControl) readJSON(v interface{}) error {
+    var size [4]byte
+    if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+        return err
+    }
+    n := binary.BigEndian.Uint32(size[:])
+    if n > 1<<20 {
+        return fmt.Errorf("iperf3 message too large: %d bytes", n)
+    }
+    b := make([]byte, n)
+    if _, err := io.ReadFull(c.conn, b); err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
+
+// newIperfCookie makes the random token that ties streams to a test.
+func newIperfCookie() ([]byte, error) {
+    const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+    b := make([]byte, iperfCookieSize)
+    if _, err := rand.Read(b); err != nil {
+        return nil, err
+    }
+    for i := range b[:iperfCookieSize-1] {
+        b[i] = alphabet[int(b[i])%len(alphabet)]
+    }
+    b[iperfCookieSize-1] = 0
+    return b, nil
+}
+
+// MeasureIperf3 runs a test against an iperf3 server: an upload, or with
+// direction "download" a reverse test in which the server sends. target may
+// omit the port. With o.UDP the streams carry UDP datagrams paced at
+// o.Rate.
+func MeasureIperf3(ctx context.Context, target, direction string, o Options) (*Iperf3Result, error) {
+    o = o.withDefaults()
+    if direction != "upload" && direction != "download" {
+        return nil, fmt.Errorf("invalid direction: %s", direction)
+    }
+    reverse := direction == "download"
+
+    address := target
+    if _, _, err := net.SplitHostPort(target); err != nil {
+        address = net.JoinHostPort(target, strconv.Itoa(Iperf3Port))
+    }
+
+    dialer := net.Dialer{Timeout: 5 * time.Second}
+    conn, err := dialer.DialContext(ctx, "tcp", address)
+    if err != nil {
+        return nil, fmt.Errorf("failed to dial iperf3 server: %w", err)
+    }
+    defer conn.Close()
+    stop := context.AfterFunc(ctx, func() {
+        conn.SetDeadline(time.Now())
+    })
+    defer stop()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    cookie, err := newIperfCookie()
+    if err != nil {
+        return nil, err
+    }
+    c := &iperfControl{conn: conn, cookie: cookie}
+    if _, err := conn.Write(cookie); err != nil {
+        return nil, fmt.Errorf("failed to send iperf3 cookie: %w", err)
+    }
+    if err := c.expect(iperfParamExchange); err != nil {
+        return nil, err
+    }
+
+    params := iperfParams{
+        TCP:           !o.UDP,
+        UDP:           o.UDP,
+        Omit:          int(math.Ceil(o.WarmUp.Seconds())),
+        Time:          int(math.Ceil((o.WarmUp + o.Duration).Seconds())),
+        Parallel:      o.Parallel,
+        Reverse:       reverse,
+        Len:           iperfTCPLen,
+        PacingTimer:   1000,
+        ClientVersion: "3.12",
+    }
+    rate := o.Rate
+    if o.UDP {
+        params.Len = iperfUDPLen
+        if rate <= 0 {
+            rate = DefaultUDPRate
+        }
+        params.Bandwidth = uint64(rate)
+    }
+    if err := c.writeJSON(params); err != nil {
+        return nil, fmt.Errorf("failed to send iperf3 parameters: %w", err)
+    }
+    if err := c.expect(iperfCreateStreams); err != nil {
+        return nil, err
+    }
+
+    // Stream IDs follow iperf3's numbering, which skips 2.
+    var streams []*iperfStream
+    var start time.Time
+    open := func(n int) ([]*stream, error) {
+        out := make([]*stream, 0, n)
+        fail := func(err error) ([]*stream, error) {
+            for _, s := range out {
+                s.close()
+            }
+            return nil, err
+        }
+        for i := 0; i < n; i++ {
+            is := &iperfStream{id: i + 1}
+            if i > 0 {
+                is.id = i + 2
+            }
+            var s *stream
+            var err error
+            if o.UDP {
+                s, err = openIperfUDP(ctx, address, is, reverse, rate, &start)
+            } else {
+                s, err = openIperfTCP(ctx, address, cookie, is, reverse)
+            }
+            if err != nil {
+                return fail(err)
+            }
+            streams = append(streams, is)
+            out = append(out, s)
+        }
+        if err := c.expect(iperfTestRunning, iperfTestStart); err != nil {
+            return fail(err)
+        }
+        start = time.Now()
+        for _, is := range streams {
+            is.counted = start.Add(time.Duration(params.Omit) * time.Second)
+        }
+        conn.SetDeadline(time.Time{})
+        return out, nil
+    }
+
+    // The results are exchanged once every stream has stopped but before
+    // any is closed, as iperf3 servers expect.
+    var ours, server iperfResults
+    var elapsed time.Duration
+    exchange := func() error {
+        elapsed = time.Since(start)
+        conn.SetDeadline(time.Now().Add(10 * time.Second))
+        if err := c.writeState(iperfTestEnd); err != nil {
+            return fmt.Errorf("failed to end iperf3 test: %w", err)
+        }
+        if err := c.expect(iperfExchangeResults); err != nil {
+            return err
+        }
+        // Our results are read now, while the connections are still open
+        // to take their retransmits from.
+        if !reverse {
+            ours.SenderHasRetransmits = 1
+        }
+        for _, is := range streams {
+            r := is.result(!reverse, elapsed)
+            if r.Retransmits < 0 {
+                ours.SenderHasRetransmits = 0
+            }
+            ours.Streams = append(ours.Streams, r)
+        }
+        if err := c.writeJSON(ours); err != nil {
+            return fmt.Errorf("failed to send iperf3 results: %w", err)
+        }
+        if err := c.readJSON(&server); err != nil {
+            return fmt.Errorf("failed to read iperf3 results: %w", err)
+        }
+        if err := c.expect(iperfDisplayResults); err != nil {
+            return err
+        }
+        return c.writeState(iperfDone)
+    }
+
+    // measure opens the streams and calls finish on each in order, so the
+    // exchange rides on the first.
+    var exchanged bool
+    m, err := measure(ctx, address, direction, o, func(n int) ([]*stream, error) {
+        out, err := open(n)
+        if err == nil && len(out) > 0 {
+            finish := out[0].finish
+            out[0].finish = func() error {
+                if finish != nil {
+                    if err := finish(); err != nil {
+                        return err
+                    }
+                }
+                exchanged = true
+                return exchange()
+            }
+        }
+        return out, err
+    })
+    if err != nil {
+        if !exchanged {
+            c.writeState(iperfClientTerminate)
+        }
+        return nil, err
+    }
+
+    protocol := "tcp"
+    if o.UDP {
+        protocol = "udp"
+    }
+    res := &Iperf3Result{Measurement: m, Protocol: protocol}
+    for i, is := range streams {
+        mine := is.result(!reverse, elapsed)
+        if i < len(ours.Streams) {
+            mine = ours.Streams[i]
+        }
+        theirs := iperfStreamResult{ID: is.id, Retransmits: -1}
+        for _, s := range server.Streams {
+            if s.ID == is.id {
+                theirs = s
+            }
+        }
+        if reverse && server.SenderHasRetransmits != 1 {
+            theirs.Retransmits = -1
+        }
+        sender, receiver := mine, theirs
+        if reverse {
+            sender, receiver = theirs, mine
+        }
+        res.Streams = append(res.Streams, Iperf3Stream{
+            ID:          is.id,
+            Sent:        sender.Bytes,
+            Received:    receiver.Bytes,
+            Retransmits: sender.Retransmits,
+            Jitter:      time.Duration(receiver.Jitter * float64(time.Second)),
+            Lost:        receiver.Errors,
+            Packets:     receiver.Packets,
+        })
+    }
+    return res, nil
+}
+
+// openIperfTCP connects a TCP data stream and identifies it with the cookie.
+func openIperfTCP(ctx context.Context, address string, cookie []byte, is *iperfStream, reverse bool) (*stream, error) {
+    dialer := net.Dialer{Timeout: 5 * time.Second}
+    conn, err := dialer.DialContext(ctx, "tcp", address)
+    if err != nil {
+        return nil, fmt.Errorf("failed to dial iperf3 stream: %w", err)
+    }
+    if _, err := conn.Write(cookie); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to send iperf3 cookie: %w", err)
+    }
+
+    buf := make([]byte, iperfTCPLen)
+    is.conn = conn
+    s := &stream{close: conn.Close, conn: func() net.Conn { return conn }}
+    if reverse {
+        s.step = func() (int, error) {
+            n, err := conn.Read(buf)
+            is.add(n)
+            return n, err
+        }
+        s.stop = func() { conn.SetReadDeadline(time.Now()) }
+    } else {
+        s.step = func() (int, error) {
+            n, err := conn.Write(buf)
+            is.add(n)
+            return n, err
+        }
+        s.stop = func() { conn.SetWriteDeadline(time.Now()) }
+    }
+    return s, nil
+}
+
+// openIperfUDP connects a UDP data stream and waits for the server to
+// acknowledge it. Sent datagrams are paced at rate bits per second, timed
+// from *start.
+func openIperfUDP(ctx context.Context, address string, is *iperfStream, reverse bool, rate float64, start *time.Time) (*stream, error) {
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "udp", address)
+    if err != nil {
+        return nil, fmt.Errorf("failed to dial iperf3 stream: %w", err)
+    }
+
+    greeting := make([]byte, 4)
+    binary.LittleEndian.PutUint32(greeting, iperfUDPConnect)
+    if _, err := conn.Write(greeting); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to open iperf3 UDP stream: %w", err)
+    }
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    reply := make([]byte, 4)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("iperf3 server did not accept UDP stream: %w", err)
+    }
+    switch binary.LittleEndian.Uint32(reply) {
+    case iperfUDPReply, iperfUDPLegacyReply, bits32Swap(iperfUDPReply), bits32Swap(iperfUDPLegacyReply):
+    default:
+        conn.Close()
+        return nil, fmt.Errorf("unexpected iperf3 UDP reply %x", reply)
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    buf := make([]byte, iperfUDPLen)
+    s := &stream{close: conn.Close}
+    if reverse {
+        s.step = func() (int, error) {
+            n, err := conn.Read(buf)
+            if err == nil {
+                is.received(buf[:n], time.Now())
+            }
+            return n, err
+        }
+        s.stop = func() { conn.SetReadDeadline(time.Now()) }
+        return s, nil
+    }
+
+    gap := time.Duration(float64(len(buf)*8) / rate * float64(time.Second))
+    var count uint32
+    s.step = func() (int, error) {
+        // Send the next datagram when the rate says it is due.
+        due := start.Add(time.Duration(count) * gap)
+        if wait := time.Until(due); wait > 0 {
+            time.Sleep(wait)
+        }
+        count++
+        now := time.Now()
+        binary.BigEndian.PutUint32(buf[0:], uint32(now.Unix()))
+        binary.BigEndian.PutUint32(buf[4:], uint32(now.Nanosecond()/1000))
+        binary.BigEndian.PutUint32(buf[8:], count)
+        n, err := conn.Write(buf)
+        if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOBUFS) {
+            err = nil // the datagram is simply lost
+        }
+        is.add(n)
+        is.mu.Lock()
+        is.packets = int(count)
+        is.mu.Unlock()
+        return n, err
+    }
+    s.stop = func() {}
+    return s, nil
+}
+
+func bits32Swap(v uint32) uint32 {
+    return v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24
+}
@@ -0,0 +1,407 @@
+package bandwidth
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// DefaultDuration is how long a test is measured for when Options doesn't
+// say.
+const DefaultDuration = 5 * time.Second
+
+// Options controls a bandwidth test.
+type Options struct {
+    // Duration is how long the test is measured for, after the warm-up.
+    // Zero means DefaultDuration.
+    Duration time.Duration
+
+    // Parallel is the number of streams run at once. Zero means one.
+    Parallel int
+
+    // WarmUp runs before measuring starts and is left out of the result, so
+    // TCP slow start doesn't drag the figures down.
+    WarmUp time.Duration
+
+    // Interval, if set, splits the measured time into periodic reports.
+    Interval time.Duration
+
+    // OnInterval, if set, is called with each report as it completes.
+    OnInterval func(Interval)
+
+    // UDP runs the test with UDP datagrams sent at Rate bits per second per
+    // stream, DefaultUDPRate if zero. Only MeasureIperf3 supports it;
+    // ProbeUDPThroughput always uses UDP.
+    UDP  bool
+    Rate float64
+
+    // UploadSize caps the body each stream of an HTTP upload sends. Zero
+    // sends until the duration is up.
+    UploadSize int64
+
+    // UploadMethod is the method of an HTTP upload, POST if empty or PUT.
+    UploadMethod string
+
+    // OnUDPInterval, if set, is called with each of a ProbeUDPThroughput
+    // test's reports as it arrives.
+    OnUDPInterval func(UDPInterval)
+}
+
+func (o Options) withDefaults() Options {
+    if o.Duration <= 0 {
+        o.Duration = DefaultDuration
+    }
+    if o.Parallel <= 0 {
+        o.Parallel = 1
+    }
+    return o
+}
+
+// Interval is the throughput of all streams over part of a test. Start and
+// End are measured from the end of the warm-up.
+type Interval struct {
+    Start time.Duration `json:"start"`
+    End   time.Duration `json:"end"`
+    Bytes int64         `json:"bytes"`
+}
+
+// BitsPerSecond returns the throughput over the interval.
+func (i Interval) BitsPerSecond() float64 {
+    return bitsPerSecond(i.Bytes, i.End-i.Start)
+}
+
+func (i Interval) String() string {
+    return fmt.Sprintf("%6.2f-%-6.2f s  %10s  %s",
+        i.Start.Seconds(), i.End.Seconds(), FormatBytes(i.Bytes), FormatBitrate(i.BitsPerSecond()))
+}
+
+// StreamResult is what a single stream of a test moved.
+type StreamResult struct {
+    Bytes    int64         `json:"bytes"`
+    Duration time.Duration `json:"duration"`
+
+    // HTTP is the timing of an HTTP stream's request.
+    HTTP *HTTPTiming `json:"http,omitempty"`
+
+    // TCPInfo samples the stream's TCP connection every interval, or every
+    // second, and once more as the test ends. Only Linux fills it in.
+    TCPInfo []TCPInfo `json:"tcp_info,omitempty"`
+}
+
+// BitsPerSecond returns the throughput of the stream.
+func (s StreamResult) BitsPerSecond() float64 {
+    return bitsPerSecond(s.Bytes, s.Duration)
+}
+
+func bitsPerSecond(bytes int64, d time.Duration) float64 {
+    if d <= 0 {
+        return 0
+    }
+    return float64(bytes) * 8 / d.Seconds()
+}
+
+// FormatBitrate renders a throughput with decimal units, as network links
+// are rated.
+func FormatBitrate(bps float64) string {
+    switch {
+    case bps >= 1e9:
+        return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+    case bps >= 1e6:
+        return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+    case bps >= 1e3:
+        return fmt.Sprintf("%.2f Kbit/s", bps/1e3)
+    }
+    return fmt.Sprintf("%.0f bit/s", bps)
+}
+
+// ParseBitrate reads a bit rate such as "500K", "50M" or "1.5G", with
+// decimal multipliers. A plain number is in bits per second.
+func ParseBitrate(s string) (float64, error) {
+    v, ok := parseScaled(s, 1e3)
+    if !ok {
+        return 0, fmt.Errorf("invalid bit rate %q", s)
+    }
+    return v, nil
+}
+
+// ParseSize reads a size such as "512K", "100M" or "1G", with binary
+// multipliers to match FormatBytes. A plain number is in bytes.
+func ParseSize(s string) (int64, error) {
+    v, ok := parseScaled(s, 1<<10)
+    if !ok {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    return int64(v), nil
+}
+
+// parseScaled reads a non-negative number with an optional K, M or G
+// suffix, each a factor of unit more than the last.
+func parseScaled(s string, unit float64) (float64, bool) {
+    mult := 1.0
+    num := strings.TrimSpace(s)
+    if n := len(num); n > 0 {
+        switch num[n-1] {
+        case 'k', 'K':
+            mult = unit
+        case 'm', 'M':
+            mult = unit * unit
+        case 'g', 'G':
+            mult = unit * unit * unit
+        }
+        if mult != 1 {
+            num = num[:n-1]
+        }
+    }
+    v, err := strconv.ParseFloat(num, 64)
+    if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+        return 0, false
+    }
+    return v * mult, true
+}
+
+// FormatBytes renders a byte count with binary units.
+func FormatBytes(n int64) string {
+    switch {
+    case n >= 1<<30:
+        return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+    case n >= 1<<20:
+        return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+    case n >= 1<<10:
+        return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+    }
+    return fmt.Sprintf("%d B", n)
+}
+
+// stream is one connection of a test.
+type stream struct {
+    // step moves one chunk of data and returns its size. io.EOF means the
+    // stream has nothing more to move.
+    step func() (int, error)
+
+    // stop unblocks a step in progress once the test is over.
+    stop func()
+
+    // finish, if set, winds the stream down after stepping has stopped.
+    finish func() error
+
+    // timing, if set, reports the stream's HTTP request timing once it has
+    // finished.
+    timing func() *HTTPTiming
+
+    // conn, if set, returns the stream's TCP connection for sampling
+    // TCP_INFO from, or nil if it has none yet.
+    conn func() net.Conn
+
+    close func() error
+}
+
+// openEach opens n streams by calling open for each, closing those already
+// open if one fails.
+func openEach(open func() (*stream, error)) func(n int) ([]*stream, error) {
+    return func(n int) ([]*stream, error) {
+        streams := make([]*stream, 0, n)
+        for i := 0; i < n; i++ {
+            s, err := open()
+            if err != nil {
+                for _, s := range streams {
+                    s.close()
+                }
+                return nil, err
+            }
+            streams = append(streams, s)
+        }
+        return streams, nil
+    }
+}
+
+// measure opens o.Parallel streams with open, moves data over them for the
+// warm-up and o.Duration, and sums up what they moved after the warm-up.
+// The test starts as soon as open returns.
+func measure(ctx context.Context, target, direction string, o Options, open func(n int) ([]*stream, error)) (*Measurement, error) {
+    o = o.withDefaults()
+
+    streams, err := open(o.Parallel)
+    if err != nil {
+        return nil, err
+    }
+    defer func() {
+        for _, s := range streams {
+            s.close()
+        }
+    }()
+
+    start := time.Now()
+    ctx, cancel := context.WithDeadline(ctx, start.Add(o.WarmUp+o.Duration))
+    defer cancel()
+
+    counts := make([]atomic.Int64, len(streams))
+    ended := make([]time.Time, len(streams))
+    errs := make([]error, len(streams))
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+    for i, s := range streams {
+        wg.Add(1)
+        go func(i int, s *stream) {
+            defer wg.Done()
+            stop := context.AfterFunc(ctx, s.stop)
+            defer stop()
+            for ctx.Err() == nil {
+                n, err := s.step()
+                counts[i].Add(int64(n))
+                if err != nil {
+                    if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+                        errs[i] = err
+                    }
+                    break
+                }
+            }
+            ended[i] = time.Now()
+        }(i, s)
+    }
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    snapshot := func() []int64 {
+        out := make([]int64, len(counts))
+        for i := range counts {
+            out[i] = counts[i].Load()
+        }
+        return out
+    }
+    sum := func(now, base []int64) int64 {
+        var total int64
+        for i := range now {
+            total += now[i] - base[i]
+        }
+        return total
+    }
+
+    // If every stream finishes during the warm-up, as a small download
+    // might, measure from the start rather than report nothing.
+    measureStart := start
+    base := make([]int64, len(streams))
+    if o.WarmUp > 0 {
+        select {
+        case <-time.After(o.WarmUp):
+            measureStart = time.Now()
+            base = snapshot()
+        case <-done:
+        }
+    }
+
+    samples := make([][]TCPInfo, len(streams))
+    sample := func() {
+        at := time.Since(measureStart)
+        for i, s := range streams {
+            if s.conn == nil {
+                continue
+            }
+            if conn := s.conn(); conn != nil {
+                if info, ok := sampleTCPInfo(conn, at); ok {
+                    samples[i] = append(samples[i], info)
+                }
+            }
+        }
+    }
+    stopSampling := make(chan struct{})
+    sampled := make(chan struct{})
+    go func() {
+        defer close(sampled)
+        every := o.Interval
+        if every <= 0 {
+            every = time.Second
+        }
+        ticker := time.NewTicker(every)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                sample()
+            case <-stopSampling:
+                return
+            }
+        }
+    }()
+
+    m := &Measurement{Target: target, Direction: direction}
+    if o.Interval > 0 {
+        ticker := time.NewTicker(o.Interval)
+        last, lastAt := base, measureStart
+    report:
+        for {
+            select {
+            case <-ticker.C:
+            case <-done:
+                break report
+            }
+            now, at := snapshot(), time.Now()
+            m.addInterval(Interval{Start: lastAt.Sub(measureStart), End: at.Sub(measureStart), Bytes: sum(now, last)}, o)
+            last, lastAt = now, at
+        }
+        ticker.Stop()
+
+        // Report whatever the last tick didn't cover.
+        var finishedAt time.Time
+        for _, t := range ended {
+            if t.After(finishedAt) {
+                finishedAt = t
+            }
+        }
+        if finishedAt.Sub(lastAt) >= time.Millisecond {
+            m.addInterval(Interval{Start: lastAt.Sub(measureStart), End: finishedAt.Sub(measureStart), Bytes: sum(snapshot(), last)}, o)
+        }
+    }
+    <-done
+    close(stopSampling)
+    <-sampled
+    sample()
+
+    for _, err := range errs {
+        if err != nil {
+            return nil, fmt.Errorf("failed to measure %s bandwidth: %w", direction, err)
+        }
+    }
+    for _, s := range streams {
+        if s.finish == nil {
+            continue
+        }
+        if err := s.finish(); err != nil {
+            return nil, err
+        }
+    }
+
+    final := snapshot()
+    for i := range streams {
+        d := ended[i].Sub(measureStart)
+        if d < 0 {
+            d = 0
+        }
+        sr := StreamResult{Bytes: final[i] - base[i], Duration: d, TCPInfo: samples[i]}
+        if streams[i].timing != nil {
+            sr.HTTP = streams[i].timing()
+        }
+        m.Streams = append(m.Streams, sr)
+        m.Bytes += final[i] - base[i]
+        if d > m.Duration {
+            m.Duration = d
+        }
+    }
+    return m, nil
+}
+
+func (m *Measurement) addInterval(i Interval, o Options) {
+    m.Intervals = append(m.Intervals, i)
+    if o.OnInterval != nil {
+        o.OnInterval(i)
+    }
+}
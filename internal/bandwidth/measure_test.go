@@ -0,0 +1,131 @@
+package bandwidth
+
+import "testing"
+
+func TestParseBitrate(t *testing.T) {
+    for _, c := range []struct {
+        in   string
+        want float64
+        ok   bool
+    }{
+        {"0", 0, true},
+        {"800", 800, true},
+        {"500K", 500e3, true},
+        {"500k", 500e3, true},
+        {"50M", 50e6, true},
+        {"1.5G", 1.5e9, true},
+        {"1g", 1e9, true},
+        {" 10M ", 10e6, true},
+        // Bit rates are decimal, unlike sizes.
+        {"1K", 1000, true},
+        {"", 0, false},
+        {"K", 0, false},
+        {"-1M", 0, false},
+        {"10Mbit", 0, false},
+        {"10MB", 0, false},
+        {"10T", 0, false},
+        {"fast", 0, false},
+        {"NaN", 0, false},
+        {"Inf", 0, false},
+    } {
+        got, err := ParseBitrate(c.in)
+        if (err == nil) != c.ok {
+            t.Errorf("ParseBitrate(%q) error = %v, want ok = %v", c.in, err, c.ok)
+            continue
+        }
+        if got != c.want {
+            t.Errorf("ParseBitrate(%q) = %v, want %v", c.in, got, c.want)
+        }
+    }
+}
+
+func TestParseSize(t *testing.T) {
+    for _, c := range []struct {
+        in   string
+        want int64
+        ok   bool
+    }{
+        {"0", 0, true},
+        {"1500", 1500, true},
+        // Sizes are binary, to match FormatBytes.
+        {"1K", 1024, true},
+        {"512k", 512 << 10, true},
+        {"100M", 100 << 20, true},
+        {"1G", 1 << 30, true},
+        {"1.5M", 3 << 19, true},
+        {"", 0, false},
+        {"M", 0, false},
+        {"-512K", 0, false},
+        {"512KB", 0, false},
+        {"512KiB", 0, false},
+        {"1T", 0, false},
+        {"big", 0, false},
+        {"NaN", 0, false},
+        {"Inf", 0, false},
+    } {
+        got, err := ParseSize(c.in)
+        if (err == nil) != c.ok {
+            t.Errorf("ParseSize(%q) error = %v, want ok = %v", c.in, err, c.ok)
+            continue
+        }
+        if got != c.want {
+            t.Errorf("ParseSize(%q) = %v, want %v", c.in, got, c.want)
+        }
+    }
+}
+
+func TestFormatBitrate(t *testing.T) {
+    for _, c := range []struct {
+        bps  float64
+        want string
+    }{
+        {0, "0 bit/s"},
+        {999, "999 bit/s"},
+        {1000, "1.00 Kbit/s"},
+        {1024, "1.02 Kbit/s"},
+        {500e3, "500.00 Kbit/s"},
+        {1e6, "1.00 Mbit/s"},
+        {94.5e6, "94.50 Mbit/s"},
+        {1e9, "1.00 Gbit/s"},
+        {2.5e9, "2.50 Gbit/s"},
+    } {
+        if got := FormatBitrate(c.bps); got != c.want {
+            t.Errorf("FormatBitrate(%v) = %q, want %q", c.bps, got, c.want)
+        }
+    }
+}
+
+func TestFormatBytes(t *testing.T) {
+    for _, c := range []struct {
+        n    int64
+        want string
+    }{
+        {0, "0 B"},
+        {1023, "1023 B"},
+        {1024, "1.00 KiB"},
+        {1000, "1000 B"},
+        {3 << 19, "1.50 MiB"},
+        {1 << 30, "1.00 GiB"},
+    } {
+        if got := FormatBytes(c.n); got != c.want {
+            t.Errorf("FormatBytes(%d) = %q, want %q", c.n, got, c.want)
+        }
+    }
+}
+
+// A rate parsed from a flag must print back as the same figure.
+func TestBitrateRoundTrip(t *testing.T) {
+    for in, want := range map[string]string{
+        "500K": "500.00 Kbit/s",
+        "50M":  "50.00 Mbit/s",
+        "1G":   "1.00 Gbit/s",
+    } {
+        bps, err := ParseBitrate(in)
+        if err != nil {
+            t.Fatalf("ParseBitrate(%q): %v", in, err)
+        }
+        if got := FormatBitrate(bps); got != want {
+            t.Errorf("FormatBitrate(ParseBitrate(%q)) = %q, want %q", in, got, want)
+        }
+    }
+}
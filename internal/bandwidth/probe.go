@@ -0,0 +1,408 @@
+package bandwidth
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "syscall"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// UDPOptions controls a UDP test against a "gonetdiag serve-probe" server.
+type UDPOptions struct {
+    Count    int           // datagrams to send
+    Interval time.Duration // time between datagrams
+    Size     int           // datagram payload size in bytes
+
+    // Wait is how long to give the last datagrams to arrive before asking
+    // the server what it saw.
+    Wait time.Duration
+}
+
+// UDPResult is what the server saw of a UDP test.
+type UDPResult struct {
+    Target     string `json:"target"`
+    Sent       int    `json:"sent"`
+    Received   int    `json:"received"`
+    Duplicates int    `json:"duplicates"`
+    Reordered  int    `json:"reordered"`
+
+    // Delay summarises the one-way delay of each datagram, as the server's
+    // arrival time minus the client's send time. Its absolute values are
+    // only meaningful when both clocks are synchronised, but the spread and
+    // jitter are meaningful either way.
+    Delay stats.Summary `json:"delay"`
+}
+
+// Lost returns the number of datagrams that never arrived.
+func (r *UDPResult) Lost() int {
+    return r.Sent - r.Received
+}
+
+// Loss returns the percentage of datagrams that never arrived.
+func (r *UDPResult) Loss() float64 {
+    if r.Sent == 0 {
+        return 0
+    }
+    return float64(r.Lost()) / float64(r.Sent) * 100
+}
+
+func (r *UDPResult) String() string {
+    s := fmt.Sprintf("UDP test to %s: Sent = %d, Received = %d, Lost = %d (%.2f%% loss), Duplicates = %d, Reordered = %d",
+        r.Target, r.Sent, r.Received, r.Lost(), r.Loss(), r.Duplicates, r.Reordered)
+    if r.Received == 0 {
+        return s
+    }
+    return s + "\nOne-way delay in milli-seconds:\n" + r.Delay.String()
+}
+
+// udpThroughputLen is the size of the datagrams of a UDP throughput test,
+// small enough to cross a 1500-byte MTU over IPv6 without fragmenting.
+const udpThroughputLen = 1400
+
+// UDPInterval is what the server saw of a UDP throughput test over part of
+// it. Jitter is the running figure at the interval's end.
+type UDPInterval struct {
+    Start     time.Duration `json:"start"`
+    End       time.Duration `json:"end"`
+    Bytes     int64         `json:"bytes"`
+    Received  int           `json:"received"`
+    Lost      int           `json:"lost"`
+    Reordered int           `json:"reordered"`
+    Jitter    time.Duration `json:"jitter"`
+}
+
+// BitsPerSecond returns the throughput that arrived over the interval.
+func (i UDPInterval) BitsPerSecond() float64 {
+    return bitsPerSecond(i.Bytes, i.End-i.Start)
+}
+
+// Loss returns the percentage of the interval's datagrams that were lost.
+func (i UDPInterval) Loss() float64 {
+    if i.Received+i.Lost == 0 {
+        return 0
+    }
+    return float64(i.Lost) / float64(i.Received+i.Lost) * 100
+}
+
+func (i UDPInterval) String() string {
+    return fmt.Sprintf("%6.2f-%-6.2f s  %10s  %13s  %8.3f ms  %5d/%-5d (%.2f%%)  %d",
+        i.Start.Seconds(), i.End.Seconds(), FormatBytes(i.Bytes), FormatBitrate(i.BitsPerSecond()),
+        float64(i.Jitter)/float64(time.Millisecond), i.Lost, i.Received+i.Lost, i.Loss(), i.Reordered)
+}
+
+// UDPThroughput is the result of a UDP throughput test.
+type UDPThroughput struct {
+    Target    string        `json:"target"`
+    Rate      float64       `json:"rate"` // target, in bits per second
+    Sent      int           `json:"sent"`
+    SentBytes int64         `json:"sent_bytes"`
+    Duration  time.Duration `json:"duration"` // spent sending
+
+    // What the server saw. ReceiveDuration runs from the first datagram's
+    // arrival to the last one's.
+    Received        int           `json:"received"`
+    Bytes           int64         `json:"bytes"`
+    ReceiveDuration time.Duration `json:"receive_duration"`
+    Duplicates      int           `json:"duplicates"`
+    Reordered       int           `json:"reordered"`
+    Jitter          time.Duration `json:"jitter"`
+    Intervals       []UDPInterval `json:"intervals,omitempty"`
+}
+
+// Lost returns the number of datagrams that never arrived.
+func (r *UDPThroughput) Lost() int {
+    return r.Sent - r.Received
+}
+
+// Loss returns the percentage of datagrams that never arrived.
+func (r *UDPThroughput) Loss() float64 {
+    if r.Sent == 0 {
+        return 0
+    }
+    return float64(r.Lost()) / float64(r.Sent) * 100
+}
+
+// BitsPerSecond returns the throughput that arrived.
+func (r *UDPThroughput) BitsPerSecond() float64 {
+    return bitsPerSecond(r.Bytes, r.ReceiveDuration)
+}
+
+func (r *UDPThroughput) String() string {
+    return fmt.Sprintf("UDP throughput to %s at %s: sent %s in %.2f s (%s)\n"+
+        "Receiver: %s, Jitter = %.3fms, Lost = %d/%d (%.2f%%), Out of order = %d, Duplicates = %d",
+        r.Target, FormatBitrate(r.Rate), FormatBytes(r.SentBytes), r.Duration.Seconds(), FormatBitrate(bitsPerSecond(r.SentBytes, r.Duration)),
+        FormatBitrate(r.BitsPerSecond()), float64(r.Jitter)/float64(time.Millisecond), r.Lost(), r.Sent, r.Loss(), r.Reordered, r.Duplicates)
+}
+
+// ProbeUpload sends data to a serve-probe server over o.Parallel connections
+// and measures the throughput. target may omit the port.
+func ProbeUpload(ctx context.Context, target string, o Options) (*Measurement, error) {
+    o = o.withDefaults()
+    if err := checkDuration(o.WarmUp + o.Duration); err != nil {
+        return nil, err
+    }
+    address := serverAddress(target)
+    h := hello{Version: protocolVersion, Test: "upload", Duration: o.WarmUp + o.Duration}
+
+    return measure(ctx, address, "upload", o, openEach(func() (*stream, error) {
+        conn, r, _, err := startTest(ctx, address, h)
+        if err != nil {
+            return nil, err
+        }
+        conn.SetDeadline(time.Time{})
+        buf := make([]byte, 128*1024)
+        return &stream{
+            step: func() (int, error) { return conn.Write(buf) },
+            stop: func() { conn.SetWriteDeadline(time.Now()) },
+            conn: func() net.Conn { return conn },
+            finish: func() error {
+                // Tell the server we're done and wait for it to agree, so
+                // it doesn't see the close as a failed upload.
+                conn.SetDeadline(time.Now().Add(10 * time.Second))
+                if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+                    return fmt.Errorf("failed to finish upload: %w", err)
+                }
+                var res result
+                if err := readLine(r, &res); err != nil {
+                    return fmt.Errorf("failed to read upload result: %w", err)
+                }
+                if res.Error != "" {
+                    return fmt.Errorf("server error: %s", res.Error)
+                }
+                return nil
+            },
+            close: conn.Close,
+        }, nil
+    }))
+}
+
+// ProbeDownload has a serve-probe server send data over o.Parallel
+// connections and measures the throughput. target may omit the port.
+func ProbeDownload(ctx context.Context, target string, o Options) (*Measurement, error) {
+    o = o.withDefaults()
+    if err := checkDuration(o.WarmUp + o.Duration); err != nil {
+        return nil, err
+    }
+    address := serverAddress(target)
+    h := hello{Version: protocolVersion, Test: "download", Duration: o.WarmUp + o.Duration}
+
+    return measure(ctx, address, "download", o, openEach(func() (*stream, error) {
+        conn, r, _, err := startTest(ctx, address, h)
+        if err != nil {
+            return nil, err
+        }
+        conn.SetDeadline(time.Time{})
+        buf := make([]byte, 128*1024)
+        return &stream{
+            step:  func() (int, error) { return r.Read(buf) },
+            stop:  func() { conn.SetReadDeadline(time.Now()) },
+            conn:  func() net.Conn { return conn },
+            close: conn.Close,
+        }, nil
+    }))
+}
+
+// ProbeUDP sends o.Count datagrams to a serve-probe server and reports the
+// loss, duplication, reordering and one-way delay the server saw.
+func ProbeUDP(ctx context.Context, target string, o UDPOptions) (*UDPResult, error) {
+    if o.Size < udpHeaderLen {
+        o.Size = udpHeaderLen
+    }
+    address := serverAddress(target)
+    conn, r, a, err := startTest(ctx, address, hello{Version: protocolVersion, Test: "udp"})
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    udp, err := dialUDP(conn, address)
+    if err != nil {
+        return nil, err
+    }
+    defer udp.Close()
+
+    // The control connection stays idle while the datagrams go out.
+    conn.SetDeadline(time.Time{})
+
+    res := &UDPResult{Target: address}
+    buf := make([]byte, o.Size)
+    for seq := 0; seq < o.Count && ctx.Err() == nil; seq++ {
+        if seq > 0 && o.Interval > 0 {
+            select {
+            case <-time.After(o.Interval):
+            case <-ctx.Done():
+            }
+        }
+        encodeDatagram(buf, a.Session, seq, time.Now())
+        if _, err := udp.Write(buf); err != nil {
+            return nil, fmt.Errorf("failed to send datagram: %w", err)
+        }
+        res.Sent++
+    }
+
+    select {
+    case <-time.After(o.Wait):
+    case <-ctx.Done():
+    }
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    if err := writeLine(conn, done{Sent: res.Sent}); err != nil {
+        return nil, fmt.Errorf("failed to end UDP test: %w", err)
+    }
+    var out result
+    if err := readLine(r, &out); err != nil {
+        return nil, fmt.Errorf("failed to read UDP result: %w", err)
+    }
+    if out.Error != "" {
+        return nil, fmt.Errorf("server error: %s", out.Error)
+    }
+    res.Received = out.Received
+    res.Duplicates = out.Duplicates
+    res.Reordered = out.Reordered
+    res.Delay = out.Delay
+    return res, nil
+}
+
+// ProbeUDPThroughput sends UDP datagrams to a serve-probe server at o.Rate
+// bits per second, DefaultUDPRate if zero, for o.Duration and reports the
+// throughput, loss, reordering and jitter the server saw. With o.Interval
+// the server also reports them every interval, passed to o.OnUDPInterval as
+// they arrive. It runs a single stream and has no warm-up.
+func ProbeUDPThroughput(ctx context.Context, target string, o Options) (*UDPThroughput, error) {
+    o = o.withDefaults()
+    if err := checkDuration(o.Duration); err != nil {
+        return nil, err
+    }
+    rate := o.Rate
+    if rate <= 0 {
+        rate = DefaultUDPRate
+    }
+    address := serverAddress(target)
+    conn, r, a, err := startTest(ctx, address, hello{Version: protocolVersion, Test: "udp", Duration: o.Duration, Interval: o.Interval})
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    udp, err := dialUDP(conn, address)
+    if err != nil {
+        return nil, err
+    }
+    defer udp.Close()
+
+    // The server's reports arrive while the datagrams go out.
+    conn.SetDeadline(time.Time{})
+    res := &UDPThroughput{Target: address, Rate: rate}
+    final := make(chan error, 1)
+    var out result
+    go func() {
+        for {
+            var line result
+            if err := readLine(r, &line); err != nil {
+                final <- err
+                return
+            }
+            if line.Interval == nil {
+                out = line
+                final <- nil
+                return
+            }
+            res.Intervals = append(res.Intervals, *line.Interval)
+            if o.OnUDPInterval != nil {
+                o.OnUDPInterval(*line.Interval)
+            }
+        }
+    }()
+
+    buf := make([]byte, udpThroughputLen)
+    gap := time.Duration(float64(len(buf)*8) / rate * float64(time.Second))
+    start := time.Now()
+    for ctx.Err() == nil {
+        // Send the next datagram when the rate says it is due, and stop on
+        // time even if the rate is more than the link can take.
+        due := start.Add(time.Duration(res.Sent) * gap)
+        if due.Sub(start) >= o.Duration || time.Since(start) >= o.Duration {
+            break
+        }
+        if wait := time.Until(due); wait > 0 {
+            time.Sleep(wait)
+        }
+        encodeDatagram(buf, a.Session, res.Sent, time.Now())
+        if _, err := udp.Write(buf); err != nil && !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, syscall.ENOBUFS) {
+            return nil, fmt.Errorf("failed to send datagram: %w", err)
+        }
+        res.Sent++
+        res.SentBytes += int64(len(buf))
+    }
+    res.Duration = time.Since(start)
+
+    // Give the last datagrams a moment to arrive.
+    select {
+    case <-time.After(250 * time.Millisecond):
+    case <-ctx.Done():
+    }
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    if err := writeLine(conn, done{Sent: res.Sent}); err != nil {
+        return nil, fmt.Errorf("failed to end UDP test: %w", err)
+    }
+    if err := <-final; err != nil {
+        return nil, fmt.Errorf("failed to read UDP result: %w", err)
+    }
+    if out.Error != "" {
+        return nil, fmt.Errorf("server error: %s", out.Error)
+    }
+    res.Received = out.Received
+    res.Bytes = out.Bytes
+    res.ReceiveDuration = out.Duration
+    res.Duplicates = out.Duplicates
+    res.Reordered = out.Reordered
+    res.Jitter = out.Jitter
+    return res, nil
+}
+
+// dialUDP connects to the UDP port of the server conn is a control
+// connection to, which has the same number as its TCP one.
+func dialUDP(conn net.Conn, address string) (net.Conn, error) {
+    host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+    _, port, _ := net.SplitHostPort(address)
+    udp, err := net.Dial("udp", net.JoinHostPort(host, port))
+    if err != nil {
+        return nil, fmt.Errorf("failed to dial UDP: %w", err)
+    }
+    return udp, nil
+}
+
+// startTest connects to the server, sends h and waits for the server to
+// accept the test.
+func startTest(ctx context.Context, address string, h hello) (net.Conn, *bufio.Reader, *ack, error) {
+    dialer := net.Dialer{Timeout: 5 * time.Second}
+    conn, err := dialer.DialContext(ctx, "tcp", address)
+    if err != nil {
+        return nil, nil, nil, fmt.Errorf("failed to dial server: %w", err)
+    }
+
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    if err := writeLine(conn, h); err != nil {
+        conn.Close()
+        return nil, nil, nil, fmt.Errorf("failed to send hello: %w", err)
+    }
+    r := bufio.NewReader(conn)
+    var a ack
+    if err := readLine(r, &a); err != nil {
+        conn.Close()
+        if errors.Is(err, io.EOF) {
+            return nil, nil, nil, fmt.Errorf("server closed the connection: is %s running gonetdiag serve-probe?", address)
+        }
+        return nil, nil, nil, fmt.Errorf("failed to read ack: %w", err)
+    }
+    if a.Error != "" {
+        conn.Close()
+        return nil, nil, nil, fmt.Errorf("server error: %s", a.Error)
+    }
+    return conn, r, &a, nil
+}
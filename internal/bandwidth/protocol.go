@@ -0,0 +1,135 @@
+package bandwidth
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// ServerPort is the TCP and UDP port "gonetdiag serve-probe" listens on by
+// default.
+const ServerPort = 7070
+
+// MaxDuration caps how long a single test may ask the server to run.
+const MaxDuration = 5 * time.Minute
+
+// MaxUDPSessions caps how many UDP tests the server runs at once.
+const MaxUDPSessions = 16
+
+// MaxTCPSessions caps how many upload and download connections the server
+// serves at once. A test with parallel streams uses one per stream.
+const MaxTCPSessions = 32
+
+// protocolVersion is sent in every hello so that a future, incompatible
+// server can refuse old clients with a clear error.
+const protocolVersion = 1
+
+// Each test runs over its own TCP connection to the server. The client opens
+// with a hello line of JSON naming the test, and the server answers with an
+// ack line. What follows depends on the test:
+//
+//   - upload: the client streams data until Duration is up and half-closes
+//     the connection. The server counts what it read and sends a result.
+//   - download: the server streams data for Duration and closes the
+//     connection. The client counts what it read.
+//   - udp: the ack carries a session. The client sends datagrams tagged with
+//     it to the server's UDP port, then a done line with how many it sent,
+//     and the server answers with a result covering what arrived. If the
+//     hello has an Interval, the server also sends a result carrying only
+//     an Interval report every Interval of the test's Duration, and one for
+//     what arrived after the last of them just before the final result.
+type hello struct {
+    Version  int           `json:"version"`
+    Test     string        `json:"test"`
+    Duration time.Duration `json:"duration,omitempty"`
+    Interval time.Duration `json:"interval,omitempty"`
+}
+
+type ack struct {
+    Error   string `json:"error,omitempty"`
+    Session uint64 `json:"session,omitempty"`
+}
+
+type done struct {
+    Sent int `json:"sent"`
+}
+
+type result struct {
+    Error    string        `json:"error,omitempty"`
+    Bytes    int64         `json:"bytes"`
+    Duration time.Duration `json:"duration"`
+
+    // UDP tests only.
+    Received   int           `json:"received,omitempty"`
+    Duplicates int           `json:"duplicates,omitempty"`
+    Reordered  int           `json:"reordered,omitempty"`
+    Delay      stats.Summary `json:"delay"`
+    Jitter     time.Duration `json:"jitter,omitempty"`
+    Interval   *UDPInterval  `json:"interval,omitempty"`
+}
+
+// udpMagic starts every UDP test datagram.
+var udpMagic = []byte("GNDB")
+
+// udpHeaderLen is the magic, the 64-bit session, a 32-bit sequence number
+// and the 64-bit send time in nanoseconds since the epoch.
+const udpHeaderLen = 24
+
+func encodeDatagram(b []byte, session uint64, seq int, sentAt time.Time) {
+    copy(b, udpMagic)
+    binary.BigEndian.PutUint64(b[4:], session)
+    binary.BigEndian.PutUint32(b[12:], uint32(seq))
+    binary.BigEndian.PutUint64(b[16:], uint64(sentAt.UnixNano()))
+}
+
+func decodeDatagram(b []byte) (session uint64, seq int, sentAt time.Time, ok bool) {
+    if len(b) < udpHeaderLen || !bytes.Equal(b[:4], udpMagic) {
+        return 0, 0, time.Time{}, false
+    }
+    session = binary.BigEndian.Uint64(b[4:])
+    seq = int(binary.BigEndian.Uint32(b[12:]))
+    sentAt = time.Unix(0, int64(binary.BigEndian.Uint64(b[16:])))
+    return session, seq, sentAt, true
+}
+
+// writeLine sends v as one line of JSON.
+func writeLine(conn net.Conn, v interface{}) error {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    _, err = conn.Write(append(b, '\n'))
+    return err
+}
+
+// readLine reads one line of JSON into v.
+func readLine(r *bufio.Reader, v interface{}) error {
+    line, err := r.ReadBytes('\n')
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(line, v)
+}
+
+// serverAddress adds the default port to target if it has none.
+func serverAddress(target string) string {
+    if _, _, err := net.SplitHostPort(target); err == nil {
+        return target
+    }
+    return net.JoinHostPort(target, strconv.Itoa(ServerPort))
+}
+
+// checkDuration rejects test durations the server won't run.
+func checkDuration(d time.Duration) error {
+    if d <= 0 || d > MaxDuration {
+        return fmt.Errorf("test duration must be between 0 and %v, got %v", MaxDuration, d)
+    }
+    return nil
+}
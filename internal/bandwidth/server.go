@@ -0,0 +1,432 @@
+package bandwidth
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// Server is the far end for upload, download and UDP tests. It listens on
+// the same port number for TCP and UDP.
+type Server struct {
+    Addr string
+
+    // Logf, if set, is told about every test run against the server.
+    Logf func(format string, args ...interface{})
+
+    mu       sync.Mutex
+    sessions map[uint64]*udpSession
+    streams  int // upload and download connections being served
+}
+
+// udpSession tracks the datagrams that arrived for one UDP test. Its size
+// doesn't grow with the test's, since anyone may run one.
+type udpSession struct {
+    received   int
+    duplicates int
+    reordered  int
+    highest    int
+    seen       seqWindow
+    delay      stats.Running
+    bytes      int64
+    first      time.Time
+    last       time.Time
+}
+
+// seqWindowSize is how far behind the highest sequence number a datagram
+// can arrive and still be told apart from a duplicate.
+const seqWindowSize = 4096
+
+// seqWindow records which of the seqWindowSize sequence numbers up to the
+// highest seen have arrived.
+type seqWindow struct {
+    floor int
+    bits  [seqWindowSize / 64]uint64
+}
+
+// mark records seq and reports whether it is new. A datagram from before the
+// window is too late to tell from a duplicate, so it is treated as one rather
+// than risk counting it twice.
+func (w *seqWindow) mark(seq int) bool {
+    if seq < w.floor {
+        return false
+    }
+    if seq >= w.floor+seqWindowSize {
+        floor := seq - seqWindowSize + 1
+        if floor-w.floor >= seqWindowSize {
+            w.bits = [seqWindowSize / 64]uint64{}
+        } else {
+            for old := w.floor; old < floor; old++ {
+                i := old % seqWindowSize
+                w.bits[i/64] &^= 1 << (i % 64)
+            }
+        }
+        w.floor = floor
+    }
+    i := seq % seqWindowSize
+    if w.bits[i/64]&(1<<(i%64)) != 0 {
+        return false
+    }
+    w.bits[i/64] |= 1 << (i % 64)
+    return true
+}
+
+// udpCounts is a udpSession's running totals at one moment, from which
+// interval reports are taken.
+type udpCounts struct {
+    at        time.Time
+    received  int
+    bytes     int64
+    reordered int
+    lost      int
+    jitter    time.Duration
+    last      time.Time // arrival of the latest datagram
+}
+
+// ListenAndServe runs the server until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+    addr := s.Addr
+    if addr == "" {
+        addr = fmt.Sprintf(":%d", ServerPort)
+    }
+
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return fmt.Errorf("failed to listen on TCP: %w", err)
+    }
+    defer ln.Close()
+
+    pc, err := net.ListenPacket("udp", addr)
+    if err != nil {
+        return fmt.Errorf("failed to listen on UDP: %w", err)
+    }
+    defer pc.Close()
+
+    s.mu.Lock()
+    s.sessions = make(map[uint64]*udpSession)
+    s.mu.Unlock()
+
+    stop := context.AfterFunc(ctx, func() {
+        ln.Close()
+        pc.Close()
+    })
+    defer stop()
+
+    go s.receiveUDP(pc)
+
+    var wg sync.WaitGroup
+    defer wg.Wait()
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil
+            }
+            return fmt.Errorf("failed to accept connection: %w", err)
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer conn.Close()
+            stop := context.AfterFunc(ctx, func() { conn.Close() })
+            defer stop()
+            if err := s.handle(conn); err != nil {
+                s.logf("%s: %v", conn.RemoteAddr(), err)
+            }
+        }()
+    }
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+    if s.Logf != nil {
+        s.Logf(format, args...)
+    }
+}
+
+// handle runs the test a client asks for on conn.
+func (s *Server) handle(conn net.Conn) error {
+    r := bufio.NewReader(conn)
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    var h hello
+    if err := readLine(r, &h); err != nil {
+        return fmt.Errorf("failed to read hello: %w", err)
+    }
+    if h.Version != protocolVersion {
+        return s.refuse(conn, fmt.Errorf("unsupported protocol version %d", h.Version))
+    }
+
+    switch h.Test {
+    case "upload":
+        if err := checkDuration(h.Duration); err != nil {
+            return s.refuse(conn, err)
+        }
+        if !s.startStream() {
+            return s.refuse(conn, fmt.Errorf("server busy with %d TCP tests", MaxTCPSessions))
+        }
+        defer s.endStream()
+        return s.upload(conn, r, h)
+    case "download":
+        if err := checkDuration(h.Duration); err != nil {
+            return s.refuse(conn, err)
+        }
+        if !s.startStream() {
+            return s.refuse(conn, fmt.Errorf("server busy with %d TCP tests", MaxTCPSessions))
+        }
+        defer s.endStream()
+        return s.download(conn, h)
+    case "udp":
+        if h.Interval < 0 || h.Duration > MaxDuration {
+            return s.refuse(conn, fmt.Errorf("invalid UDP test interval %v or duration %v", h.Interval, h.Duration))
+        }
+        return s.udp(conn, r, h)
+    default:
+        return s.refuse(conn, fmt.Errorf("unknown test %q", h.Test))
+    }
+}
+
+// startStream takes one of the MaxTCPSessions upload and download slots,
+// reporting false if they are all in use.
+func (s *Server) startStream() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.streams >= MaxTCPSessions {
+        return false
+    }
+    s.streams++
+    return true
+}
+
+func (s *Server) endStream() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.streams--
+}
+
+func (s *Server) refuse(conn net.Conn, err error) error {
+    writeLine(conn, ack{Error: err.Error()})
+    return err
+}
+
+// upload reads what the client sends until it half-closes the connection,
+// then reports how much arrived and over how long.
+func (s *Server) upload(conn net.Conn, r *bufio.Reader, h hello) error {
+    s.logf("%s: upload for %v", conn.RemoteAddr(), h.Duration)
+    if err := writeLine(conn, ack{}); err != nil {
+        return err
+    }
+
+    conn.SetDeadline(time.Now().Add(h.Duration + 10*time.Second))
+    if _, err := r.Peek(1); err != nil {
+        return fmt.Errorf("failed to read upload: %w", err)
+    }
+    start := time.Now()
+    n, err := io.Copy(io.Discard, r)
+    if err != nil {
+        return fmt.Errorf("failed to read upload: %w", err)
+    }
+    return writeLine(conn, result{Bytes: n, Duration: time.Since(start)})
+}
+
+// download streams data to the client for the requested duration.
+func (s *Server) download(conn net.Conn, h hello) error {
+    s.logf("%s: download for %v", conn.RemoteAddr(), h.Duration)
+    if err := writeLine(conn, ack{}); err != nil {
+        return err
+    }
+
+    conn.SetDeadline(time.Now().Add(h.Duration + 10*time.Second))
+    buf := make([]byte, 128*1024)
+    for start := time.Now(); time.Since(start) < h.Duration; {
+        if _, err := conn.Write(buf); err != nil {
+            // Clients close the connection when their own clock says the
+            // test is over, which may be just before ours does.
+            if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+                return nil
+            }
+            return fmt.Errorf("failed to write download: %w", err)
+        }
+    }
+    return nil
+}
+
+// udp opens a session for the client's datagrams and, once the client says
+// it is done, reports what arrived.
+func (s *Server) udp(conn net.Conn, r *bufio.Reader, h hello) error {
+    var b [8]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return s.refuse(conn, err)
+    }
+    id := binary.BigEndian.Uint64(b[:])
+
+    s.mu.Lock()
+    if len(s.sessions) >= MaxUDPSessions {
+        s.mu.Unlock()
+        return s.refuse(conn, fmt.Errorf("server busy with %d UDP tests", MaxUDPSessions))
+    }
+    s.sessions[id] = &udpSession{highest: -1}
+    s.mu.Unlock()
+    defer func() {
+        s.mu.Lock()
+        delete(s.sessions, id)
+        s.mu.Unlock()
+    }()
+
+    s.logf("%s: UDP test", conn.RemoteAddr())
+    if err := writeLine(conn, ack{Session: id}); err != nil {
+        return err
+    }
+
+    stopReports := make(chan struct{})
+    var reporting sync.WaitGroup
+    if h.Interval > 0 {
+        reporting.Add(1)
+        go func() {
+            defer reporting.Done()
+            s.reportUDP(conn, id, h, stopReports)
+        }()
+    }
+
+    conn.SetDeadline(time.Now().Add(MaxDuration + 10*time.Second))
+    var d done
+    err := readLine(r, &d)
+    close(stopReports)
+    reporting.Wait()
+    if err != nil {
+        return fmt.Errorf("failed to read UDP test end: %w", err)
+    }
+
+    s.mu.Lock()
+    session := s.sessions[id]
+    delay := session.delay.Summary()
+    res := result{
+        Bytes:      session.bytes,
+        Duration:   session.last.Sub(session.first),
+        Received:   session.received,
+        Duplicates: session.duplicates,
+        Reordered:  session.reordered,
+        Delay:      delay,
+        Jitter:     delay.Jitter,
+    }
+    s.mu.Unlock()
+    return writeLine(conn, res)
+}
+
+// reportUDP sends an interval report for session id every h.Interval until
+// h.Duration is up, then waits for stop and reports whatever arrived after
+// the last of them.
+func (s *Server) reportUDP(conn net.Conn, id uint64, h hello, stop <-chan struct{}) {
+    counts := func() udpCounts {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return s.sessions[id].counts()
+    }
+    report := func(from, to udpCounts, start time.Time) error {
+        i := UDPInterval{
+            Start:     from.at.Sub(start),
+            End:       to.at.Sub(start),
+            Bytes:     to.bytes - from.bytes,
+            Received:  to.received - from.received,
+            Lost:      max(0, to.lost-from.lost),
+            Reordered: to.reordered - from.reordered,
+            Jitter:    to.jitter,
+        }
+        return writeLine(conn, result{Interval: &i})
+    }
+
+    start := time.Now()
+    last := udpCounts{at: start}
+    ticker := time.NewTicker(h.Interval)
+    defer ticker.Stop()
+    for time.Since(start)+h.Interval <= h.Duration {
+        select {
+        case <-ticker.C:
+        case <-stop:
+            return
+        }
+        now := counts()
+        if err := report(last, now, start); err != nil {
+            return
+        }
+        last = now
+    }
+    <-stop
+
+    // The last report runs to the last datagram, not to when the client
+    // said it was done.
+    now := counts()
+    if now.last.Sub(last.at) >= time.Millisecond {
+        now.at = now.last
+        report(last, now, start)
+    }
+}
+
+// receiveUDP files every test datagram under its session.
+func (s *Server) receiveUDP(pc net.PacketConn) {
+    buf := make([]byte, 65535)
+    for {
+        n, _, err := pc.ReadFrom(buf)
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            continue
+        }
+        arrived := time.Now()
+        id, seq, sentAt, ok := decodeDatagram(buf[:n])
+        if !ok {
+            continue
+        }
+
+        s.mu.Lock()
+        if session, ok := s.sessions[id]; ok {
+            session.add(seq, n, arrived, sentAt)
+        }
+        s.mu.Unlock()
+    }
+}
+
+func (u *udpSession) add(seq, size int, arrived, sentAt time.Time) {
+    if !u.seen.mark(seq) {
+        u.duplicates++
+        return
+    }
+    if u.received == 0 {
+        u.first = arrived
+    }
+    u.last = arrived
+    u.received++
+    u.bytes += int64(size)
+    if seq < u.highest {
+        u.reordered++
+    } else {
+        u.highest = seq
+    }
+    // The jitter of one-way delays doesn't depend on the clocks being
+    // synchronised, since it only looks at their differences.
+    u.delay.Add(arrived.Sub(sentAt))
+}
+
+// counts returns the session's totals so far. Datagrams missing below the
+// highest sequence number seen count as lost until they turn up.
+func (u *udpSession) counts() udpCounts {
+    return udpCounts{
+        at:        time.Now(),
+        received:  u.received,
+        bytes:     u.bytes,
+        reordered: u.reordered,
+        lost:      max(0, u.highest+1-u.received),
+        jitter:    u.delay.Summary().Jitter,
+        last:      u.last,
+    }
+}
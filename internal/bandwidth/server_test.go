@@ -0,0 +1,45 @@
+package bandwidth
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSeqWindow(t *testing.T) {
+    var w seqWindow
+    for _, c := range []struct {
+        seq int
+        new bool
+    }{
+        {0, true},
+        {2, true},
+        {1, true}, // reordered, but not seen before
+        {2, false},
+        {seqWindowSize + 5, true}, // slides the window past 0 to 5
+        {5, false},                // now before the window
+        {6, true},
+        {6, false},
+        {seqWindowSize + 5, false},
+        {10 * seqWindowSize, true}, // slides the window right past itself
+        {seqWindowSize + 5, false},
+        {10*seqWindowSize - 1, true},
+    } {
+        if got := w.mark(c.seq); got != c.new {
+            t.Errorf("mark(%d) = %v, want %v", c.seq, got, c.new)
+        }
+    }
+}
+
+func TestUDPSessionDuplicates(t *testing.T) {
+    u := &udpSession{highest: -1}
+    now := time.Unix(1700000000, 0)
+    for _, seq := range []int{0, 1, 1, 3, 2, 3} {
+        u.add(seq, 100, now, now)
+    }
+    if u.received != 4 || u.duplicates != 2 || u.reordered != 1 {
+        t.Errorf("received %d, duplicates %d, reordered %d, want 4, 2, 1", u.received, u.duplicates, u.reordered)
+    }
+    if c := u.counts(); c.lost != 0 || c.bytes != 400 {
+        t.Errorf("lost %d, bytes %d, want 0, 400", c.lost, c.bytes)
+    }
+}
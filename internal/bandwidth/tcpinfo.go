@@ -0,0 +1,53 @@
+package bandwidth
+
+import (
+    "fmt"
+    "net"
+    "time"
+)
+
+// TCPInfo is the kernel's view of a stream's TCP connection at one moment,
+// from TCP_INFO. It is only sampled on Linux.
+type TCPInfo struct {
+    // At is when the sample was taken, from the end of the warm-up.
+    At time.Duration `json:"at"`
+
+    Retransmits  uint32        `json:"retransmits"` // over the connection's life
+    RTT          time.Duration `json:"rtt"`
+    RTTVar       time.Duration `json:"rttvar"`
+    Cwnd         uint32        `json:"cwnd"` // in segments
+    PacingRate   float64       `json:"pacing_rate"`   // bits per second
+    DeliveryRate float64       `json:"delivery_rate"` // bits per second
+    BytesAcked   uint64        `json:"bytes_acked"`
+}
+
+func (t TCPInfo) String() string {
+    return fmt.Sprintf("Retransmits = %d, RTT = %.3fms (var %.3fms), Cwnd = %d, Pacing rate = %s, Delivery rate = %s, Bytes acked = %s",
+        t.Retransmits, float64(t.RTT)/float64(time.Millisecond), float64(t.RTTVar)/float64(time.Millisecond), t.Cwnd,
+        FormatBitrate(t.PacingRate), FormatBitrate(t.DeliveryRate), FormatBytes(int64(t.BytesAcked)))
+}
+
+// netConner is implemented by connections wrapping another, such as
+// *tls.Conn.
+type netConner interface {
+    NetConn() net.Conn
+}
+
+// sampleTCPInfo reads TCP_INFO from conn, unwrapping TLS first. It reports
+// false if conn is not a TCP connection or the platform has no TCP_INFO.
+func sampleTCPInfo(conn net.Conn, at time.Duration) (TCPInfo, bool) {
+    for {
+        inner, ok := conn.(netConner)
+        if !ok {
+            break
+        }
+        conn = inner.NetConn()
+    }
+    tcp, ok := conn.(*net.TCPConn)
+    if !ok {
+        return TCPInfo{}, false
+    }
+    info, ok := readTCPInfo(tcp)
+    info.At = at
+    return info, ok
+}
@@ -0,0 +1,37 @@
+package bandwidth
+
+import (
+    "math"
+    "net"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+func readTCPInfo(conn *net.TCPConn) (TCPInfo, bool) {
+    rc, err := conn.SyscallConn()
+    if err != nil {
+        return TCPInfo{}, false
+    }
+    var info *unix.TCPInfo
+    var sockErr error
+    err = rc.Control(func(fd uintptr) {
+        info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+    })
+    if err != nil || sockErr != nil {
+        return TCPInfo{}, false
+    }
+    // The kernel reports an unlimited pacing rate as all ones.
+    if info.Pacing_rate == math.MaxUint64 {
+        info.Pacing_rate = 0
+    }
+    return TCPInfo{
+        Retransmits:  info.Total_retrans,
+        RTT:          time.Duration(info.Rtt) * time.Microsecond,
+        RTTVar:       time.Duration(info.Rttvar) * time.Microsecond,
+        Cwnd:         info.Snd_cwnd,
+        PacingRate:   float64(info.Pacing_rate) * 8,
+        DeliveryRate: float64(info.Delivery_rate) * 8,
+        BytesAcked:   info.Bytes_acked,
+    }, true
+}
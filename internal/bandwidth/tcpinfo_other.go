@@ -0,0 +1,9 @@
+//go:build !linux
+
+package bandwidth
+
+import "net"
+
+func readTCPInfo(conn *net.TCPConn) (TCPInfo, bool) {
+    return TCPInfo{}, false
+}
@@ -0,0 +1,241 @@
+package bufferbloat
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/bandwidth"
+    "github.com/Dyst0rti0n/gonetdiag/internal/ping"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// DefaultIdle is how long the idle latency is measured for when Options
+// doesn't say.
+const DefaultIdle = 5 * time.Second
+
+// Load saturates the link in one direction for the warm-up and duration in
+// o, and returns what it moved.
+type Load func(ctx context.Context, o bandwidth.Options) (*bandwidth.Measurement, error)
+
+// Options controls a bufferbloat test.
+type Options struct {
+    // Ping says how latency is measured. Count is ignored. Interval
+    // defaults to 100ms and Timeout to two seconds.
+    Ping ping.Options
+
+    // Idle is how long latency is measured for before any load, DefaultIdle
+    // if zero.
+    Idle time.Duration
+
+    // Bandwidth is passed to Download and Upload. Latency under load is only
+    // measured once its warm-up is over, so the queues have had time to fill.
+    Bandwidth bandwidth.Options
+
+    // Download and Upload load the link in each direction. A nil Load skips
+    // that direction.
+    Download Load
+    Upload   Load
+}
+
+// Phase is the latency measured while the link was loaded in one direction.
+type Phase struct {
+    Direction string        `json:"direction"`
+    Sent      int           `json:"sent"`
+    Received  int           `json:"received"`
+    RTT       stats.Summary `json:"rtt"`
+
+    // Added is how much the median round trip time grew over the idle one.
+    Added time.Duration `json:"added"`
+    Grade string        `json:"grade"`
+
+    Throughput *bandwidth.Measurement `json:"throughput"`
+}
+
+// Loss returns the percentage of pings under load that went unanswered.
+func (p *Phase) Loss() float64 {
+    if p.Sent == 0 {
+        return 0
+    }
+    return float64(p.Sent-p.Received) / float64(p.Sent) * 100
+}
+
+func (p *Phase) String() string {
+    name := strings.ToUpper(p.Direction[:1]) + p.Direction[1:]
+    if p.Received == 0 {
+        return fmt.Sprintf("%s: Grade %s, no replies to %d pings under load at %s",
+            name, p.Grade, p.Sent, bandwidth.FormatBitrate(p.Throughput.BitsPerSecond()))
+    }
+    return fmt.Sprintf("%s: Grade %s, +%.3fms under load at %s (Median = %.3fms, P95 = %.3fms, Jitter = %.3fms, Loss = %.2f%%)",
+        name, p.Grade, stats.Milliseconds(p.Added), bandwidth.FormatBitrate(p.Throughput.BitsPerSecond()),
+        stats.Milliseconds(p.RTT.Median), stats.Milliseconds(p.RTT.P95), stats.Milliseconds(p.RTT.Jitter), p.Loss())
+}
+
+// Result is the outcome of a bufferbloat test. Grade is the worse of the
+// two directions'.
+type Result struct {
+    Target   string        `json:"target"`
+    Grade    string        `json:"grade"`
+    Sent     int           `json:"sent"`
+    Received int           `json:"received"`
+    Idle     stats.Summary `json:"idle"`
+    Download *Phase        `json:"download,omitempty"`
+    Upload   *Phase        `json:"upload,omitempty"`
+}
+
+func (r *Result) String() string {
+    lines := []string{
+        fmt.Sprintf("Bufferbloat to %s: Grade %s", r.Target, r.Grade),
+        fmt.Sprintf("Idle: Median = %.3fms, P95 = %.3fms, Jitter = %.3fms (%d of %d pings answered)",
+            stats.Milliseconds(r.Idle.Median), stats.Milliseconds(r.Idle.P95), stats.Milliseconds(r.Idle.Jitter), r.Received, r.Sent),
+    }
+    for _, p := range []*Phase{r.Download, r.Upload} {
+        if p != nil {
+            lines = append(lines, p.String())
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// grades are the added latency each grade allows, best first.
+var grades = []struct {
+    grade string
+    added time.Duration
+}{
+    {"A+", 5 * time.Millisecond},
+    {"A", 30 * time.Millisecond},
+    {"B", 60 * time.Millisecond},
+    {"C", 200 * time.Millisecond},
+    {"D", 400 * time.Millisecond},
+}
+
+// Grade rates the latency a load added, from A+ for under 5ms, which no
+// interactive use will notice, to F for 400ms or more, which makes calls
+// and games unusable.
+func Grade(added time.Duration) string {
+    for _, g := range grades {
+        if added < g.added {
+            return g.grade
+        }
+    }
+    return "F"
+}
+
+// worse returns the lower of two grades.
+func worse(a, b string) string {
+    rank := func(g string) int {
+        for i, x := range grades {
+            if x.grade == g {
+                return i
+            }
+        }
+        return len(grades)
+    }
+    if rank(b) > rank(a) {
+        return b
+    }
+    return a
+}
+
+// Run measures the latency to target while the link is idle, then while
+// o.Download and o.Upload load it in turn, and grades how much the load
+// added.
+func Run(ctx context.Context, target string, o Options) (*Result, error) {
+    if o.Idle <= 0 {
+        o.Idle = DefaultIdle
+    }
+    if o.Ping.Interval <= 0 {
+        o.Ping.Interval = 100 * time.Millisecond
+    }
+    if o.Ping.Timeout <= 0 {
+        o.Ping.Timeout = 2 * time.Second
+    }
+    o.Ping.OnSample = nil
+    if o.Bandwidth.Duration <= 0 {
+        o.Bandwidth.Duration = bandwidth.DefaultDuration
+    }
+
+    po := o.Ping
+    // A count of zero would ping until ctx is done, so always send one.
+    po.Count = max(1, int(o.Idle/po.Interval))
+    idle, err := ping.Ping(ctx, target, po)
+    if err != nil {
+        return nil, fmt.Errorf("failed to measure idle latency: %w", err)
+    }
+    if idle.Received == 0 {
+        return nil, fmt.Errorf("no replies from %s to %d pings while idle", target, idle.Sent)
+    }
+
+    r := &Result{Target: target, Grade: "A+", Sent: idle.Sent, Received: idle.Received, Idle: idle.RTT}
+    for _, d := range []struct {
+        name  string
+        load  Load
+        phase **Phase
+    }{
+        {"download", o.Download, &r.Download},
+        {"upload", o.Upload, &r.Upload},
+    } {
+        if d.load == nil {
+            continue
+        }
+        p, err := loaded(ctx, target, d.name, d.load, o)
+        if err != nil {
+            return nil, err
+        }
+        if p.Received > 0 {
+            p.Added = max(0, p.RTT.Median-idle.RTT.Median)
+            p.Grade = Grade(p.Added)
+        } else {
+            p.Grade = "F"
+        }
+        *d.phase = p
+        r.Grade = worse(r.Grade, p.Grade)
+    }
+    return r, nil
+}
+
+// loaded pings target while load runs, from the end of its warm-up until it
+// finishes.
+func loaded(ctx context.Context, target, direction string, load Load, o Options) (*Phase, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    type pinged struct {
+        stats *ping.PingStats
+        err   error
+    }
+    results := make(chan pinged, 1)
+    go func() {
+        select {
+        case <-time.After(o.Bandwidth.WarmUp):
+        case <-ctx.Done():
+            results <- pinged{}
+            return
+        }
+        po := o.Ping
+        po.Count = max(1, int(o.Bandwidth.Duration/po.Interval))
+        ps, err := ping.Ping(ctx, target, po)
+        results <- pinged{ps, err}
+    }()
+
+    m, err := load(ctx, o.Bandwidth)
+    cancel()
+    p := <-results
+    if err != nil {
+        return nil, fmt.Errorf("failed to load %s: %w", direction, err)
+    }
+    if p.err != nil {
+        return nil, fmt.Errorf("failed to measure latency under %s load: %w", direction, p.err)
+    }
+    if p.stats == nil {
+        return nil, fmt.Errorf("%s load finished before its warm-up was over", direction)
+    }
+    return &Phase{
+        Direction:  direction,
+        Sent:       p.stats.Sent,
+        Received:   p.stats.Received,
+        RTT:        p.stats.RTT,
+        Throughput: m,
+    }, nil
+}
@@ -0,0 +1,329 @@
+package icmp
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+
+    xicmp "golang.org/x/net/icmp"
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// ErrorKind classifies the ICMP error messages a router or host can send back
+// in place of an echo reply.
+type ErrorKind int
+
+const (
+    DestinationUnreachable ErrorKind = iota + 1
+    TimeExceeded
+    Redirect
+    ParameterProblem
+    PacketTooBig // ICMPv6 only; IPv4 reports this as unreachable, code 4
+)
+
+// Destination Unreachable codes for IPv4 (RFC 792, RFC 1812).
+const (
+    CodeNetUnreachable      = 0
+    CodeHostUnreachable     = 1
+    CodeProtocolUnreachable = 2
+    CodePortUnreachable     = 3
+    CodeFragmentationNeeded = 4
+    CodeNetProhibited       = 9
+    CodeHostProhibited      = 10
+    CodeAdminProhibited     = 13
+)
+
+// Error is an ICMP error message that quotes one of our own requests, so it
+// can be tied back to the probe that caused it.
+type Error struct {
+    Kind ErrorKind
+    Code int
+    From net.Addr
+    Seq  int // sequence number of the request it refers to
+
+    // MTU is the next-hop MTU for fragmentation needed and packet too big,
+    // Gateway the new next hop for a redirect and Pointer the offending
+    // octet for a parameter problem. Each is only set for its own kind.
+    MTU     int
+    Gateway net.IP
+    Pointer int
+
+    v6 bool
+}
+
+func (e *Error) Error() string {
+    if e.From == nil {
+        return e.Message()
+    }
+    return fmt.Sprintf("%s from %s", e.Message(), e.From)
+}
+
+// Message describes the error the way ping does, without its source.
+func (e *Error) Message() string {
+    if e.v6 {
+        return e.message6()
+    }
+    switch e.Kind {
+    case DestinationUnreachable:
+        switch e.Code {
+        case CodeNetUnreachable:
+            return "Destination Net Unreachable"
+        case CodeHostUnreachable:
+            return "Destination Host Unreachable"
+        case CodeProtocolUnreachable:
+            return "Destination Protocol Unreachable"
+        case CodePortUnreachable:
+            return "Destination Port Unreachable"
+        case CodeFragmentationNeeded:
+            return fmt.Sprintf("Frag needed and DF set (mtu = %d)", e.MTU)
+        case 5:
+            return "Source Route Failed"
+        case 6:
+            return "Destination Net Unknown"
+        case 7:
+            return "Destination Host Unknown"
+        case CodeNetProhibited:
+            return "Destination Net Prohibited"
+        case CodeHostProhibited:
+            return "Destination Host Prohibited"
+        case CodeAdminProhibited:
+            return "Communication Administratively Prohibited"
+        }
+        return fmt.Sprintf("Destination Unreachable, Bad Code: %d", e.Code)
+    case TimeExceeded:
+        if e.Code == 1 {
+            return "Frag reassembly time exceeded"
+        }
+        return "Time to live exceeded"
+    case Redirect:
+        kinds := []string{"Network", "Host", "Type of Service and Network", "Type of Service and Host"}
+        if e.Code < len(kinds) {
+            return fmt.Sprintf("Redirect %s (New nexthop: %s)", kinds[e.Code], e.Gateway)
+        }
+        return fmt.Sprintf("Redirect, Bad Code: %d (New nexthop: %s)", e.Code, e.Gateway)
+    case ParameterProblem:
+        return fmt.Sprintf("Parameter problem: pointer = %d", e.Pointer)
+    }
+    return fmt.Sprintf("ICMP error, kind %d code %d", e.Kind, e.Code)
+}
+
+func (e *Error) message6() string {
+    switch e.Kind {
+    case DestinationUnreachable:
+        switch e.Code {
+        case 0:
+            return "Destination unreachable: No route"
+        case 1:
+            return "Destination unreachable: Administratively prohibited"
+        case 2:
+            return "Destination unreachable: Beyond scope of source address"
+        case 3:
+            return "Destination unreachable: Address unreachable"
+        case 4:
+            return "Destination unreachable: Port unreachable"
+        case 5:
+            return "Destination unreachable: Source address failed ingress/egress policy"
+        case 6:
+            return "Destination unreachable: Reject route to destination"
+        }
+        return fmt.Sprintf("Destination unreachable: Unknown code %d", e.Code)
+    case PacketTooBig:
+        return fmt.Sprintf("Packet too big: mtu=%d", e.MTU)
+    case TimeExceeded:
+        if e.Code == 1 {
+            return "Time exceeded: Fragment reassembly time exceeded"
+        }
+        return "Time exceeded: Hop limit"
+    case Redirect:
+        return fmt.Sprintf("Redirect (New nexthop: %s)", e.Gateway)
+    case ParameterProblem:
+        return fmt.Sprintf("Parameter problem: pointer = %d", e.Pointer)
+    }
+    return fmt.Sprintf("ICMPv6 error, kind %d code %d", e.Kind, e.Code)
+}
+
+// Unreachable reports whether the error means the destination cannot be
+// reached at all, as opposed to a hop along the way giving up on a packet.
+func (e *Error) Unreachable() bool {
+    return e.Kind == DestinationUnreachable || e.Kind == PacketTooBig
+}
+
+// decodeError classifies msg, whose raw bytes are b, as an ICMP error. It
+// returns nil for anything that isn't one. The quoted datagram is not checked
+// here; see Session.matchQuoted.
+func decodeError(v6 bool, msg *xicmp.Message, b []byte) (*Error, []byte) {
+    if len(b) < 8 {
+        return nil, nil
+    }
+    e := &Error{Code: msg.Code, v6: v6}
+    rest, quoted := b[4:8], b[8:]
+
+    switch msg.Type {
+    case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+        e.Kind = DestinationUnreachable
+        if !v6 && e.Code == CodeFragmentationNeeded {
+            e.MTU = int(binary.BigEndian.Uint16(rest[2:4]))
+        }
+    case ipv6.ICMPTypePacketTooBig:
+        e.Kind = PacketTooBig
+        e.MTU = int(binary.BigEndian.Uint32(rest))
+    case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+        e.Kind = TimeExceeded
+    case ipv4.ICMPTypeRedirect:
+        e.Kind = Redirect
+        e.Gateway = net.IP(append([]byte(nil), rest...))
+    case ipv6.ICMPTypeRedirect:
+        // An ICMPv6 redirect carries the target and destination addresses
+        // rather than a copy of our packet, followed by options, one of
+        // which may hold the redirected header.
+        if len(b) < 40 {
+            return nil, nil
+        }
+        e.Kind = Redirect
+        e.Gateway = net.IP(append([]byte(nil), b[8:24]...))
+        quoted = redirectedHeader(b[40:])
+    case ipv4.ICMPTypeParameterProblem:
+        e.Kind = ParameterProblem
+        e.Pointer = int(rest[0])
+    case ipv6.ICMPTypeParameterProblem:
+        e.Kind = ParameterProblem
+        e.Pointer = int(binary.BigEndian.Uint32(rest))
+    default:
+        return nil, nil
+    }
+    return e, quoted
+}
+
+// redirectedHeader finds the Redirected Header option (RFC 4861 section
+// 4.6.3) among ICMPv6 redirect options and returns the packet it quotes.
+func redirectedHeader(opts []byte) []byte {
+    for len(opts) >= 8 {
+        length := int(opts[1]) * 8
+        if length == 0 || length > len(opts) {
+            return nil
+        }
+        if opts[0] == 4 {
+            return opts[8:length]
+        }
+        opts = opts[length:]
+    }
+    return nil
+}
+
+// matchQuoted checks that quoted, the start of the datagram an ICMP error
+// refers to, is an echo request from this session that we are still waiting
+// on, and returns its sequence number.
+func (s *Session) matchQuoted(quoted []byte) (int, error) {
+    var proto, hdrLen int
+    var requestType byte
+    if s.v6 {
+        if len(quoted) < ipv6.HeaderLen || quoted[0]>>4 != 6 {
+            return 0, errors.New("quoted datagram is not IPv6")
+        }
+        proto, hdrLen, requestType = int(quoted[6]), ipv6.HeaderLen, byte(ipv6.ICMPTypeEchoRequest)
+    } else {
+        if len(quoted) < ipv4.HeaderLen || quoted[0]>>4 != 4 {
+            return 0, errors.New("quoted datagram is not IPv4")
+        }
+        proto, hdrLen, requestType = int(quoted[9]), int(quoted[0]&0x0f)<<2, byte(ipv4.ICMPTypeEcho)
+    }
+    wantProto := protocolICMP
+    if s.v6 {
+        wantProto = protocolIPv6ICMP
+    }
+    if proto != wantProto {
+        return 0, fmt.Errorf("quoted datagram carries protocol %d", proto)
+    }
+    // RFC 792 guarantees at least the first 8 bytes of the original
+    // payload, which is exactly the echo header.
+    if len(quoted) < hdrLen+8 {
+        return 0, errors.New("quoted datagram is truncated")
+    }
+    echo := quoted[hdrLen:]
+    if echo[0] != requestType {
+        return 0, fmt.Errorf("quoted datagram is ICMP type %d, not an echo request", echo[0])
+    }
+    id := int(binary.BigEndian.Uint16(echo[4:6]))
+    seq := int(binary.BigEndian.Uint16(echo[6:8]))
+    if id != s.ID {
+        return 0, fmt.Errorf("quoted echo identifier %d belongs to another session", id)
+    }
+    if !s.outstanding(seq) {
+        return 0, fmt.Errorf("quoted echo sequence %d is not outstanding", seq)
+    }
+    return seq, nil
+}
+
+// ReceiveError waits up to timeout for an ICMP error about a datagram of
+// protocol proto sent to dst, such as a UDP or TCP probe, and returns it with
+// the start of that datagram's transport header, at least 8 bytes of which
+// are always quoted. The error's Seq is not set; matching the header to a
+// probe is up to the caller. Everything else that arrives on the socket,
+// echo replies included, is discarded. It returns ctx.Err() as soon as ctx
+// is done.
+func (s *Session) ReceiveError(ctx context.Context, proto int, dst net.IP, timeout time.Duration) (*Error, []byte, error) {
+    if err := s.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+        return nil, nil, err
+    }
+    stop := context.AfterFunc(ctx, func() {
+        s.conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    icmpProto := protocolICMP
+    if s.v6 {
+        icmpProto = protocolIPv6ICMP
+    }
+    buf := make([]byte, 1500)
+    for {
+        n, _, src, err := s.readMessage(buf)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, nil, ctx.Err()
+            }
+            return nil, nil, err
+        }
+        msg, err := xicmp.ParseMessage(icmpProto, buf[:n])
+        if err != nil {
+            continue
+        }
+        icmpErr, quoted := decodeError(s.v6, msg, buf[:n])
+        if icmpErr == nil {
+            continue
+        }
+        header, ok := quotedTransport(s.v6, quoted, proto, dst)
+        if !ok {
+            continue
+        }
+        icmpErr.From = src
+        return icmpErr, append([]byte(nil), header...), nil
+    }
+}
+
+// quotedTransport checks that quoted, the start of the datagram an ICMP error
+// refers to, was of protocol proto and sent to dst, and returns its
+// transport header.
+func quotedTransport(v6 bool, quoted []byte, proto int, dst net.IP) ([]byte, bool) {
+    var hdrLen int
+    var quotedProto int
+    var quotedDst net.IP
+    if v6 {
+        if len(quoted) < ipv6.HeaderLen || quoted[0]>>4 != 6 {
+            return nil, false
+        }
+        hdrLen, quotedProto, quotedDst = ipv6.HeaderLen, int(quoted[6]), net.IP(quoted[24:40])
+    } else {
+        if len(quoted) < ipv4.HeaderLen || quoted[0]>>4 != 4 {
+            return nil, false
+        }
+        hdrLen, quotedProto, quotedDst = int(quoted[0]&0x0f)<<2, int(quoted[9]), net.IP(quoted[16:20])
+    }
+    if quotedProto != proto || !quotedDst.Equal(dst) || len(quoted) < hdrLen+8 {
+        return nil, false
+    }
+    return quoted[hdrLen:], true
+}
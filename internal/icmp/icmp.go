@@ -1,34 +1,396 @@
 package icmp
 
 import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand/v2"
     "net"
-	"time"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
 
+    xicmp "golang.org/x/net/icmp"
     "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
 )
 
-func SendICMPRequest(conn *ipv4.PacketConn, destAddr *net.IPAddr, seq int) error {
+const (
+    protocolICMP     = 1  // IANA protocol number for ICMP over IPv4
+    protocolIPv6ICMP = 58 // IANA protocol number for ICMPv6
+)
+
+// nextID hands out echo identifiers. It starts at a random value so that
+// separate gonetdiag processes on the same host are unlikely to collide, and
+// increments so that sessions within one process never do.
+var nextID = rand.Uint32()
+
+// Options controls how targets are resolved and probed.
+type Options struct {
+    // Network forces an address family: "ip4" or "ip6". When empty the
+    // family is picked from the target, preferring IPv4 for dual-stack names.
+    Network string
+
+    // Privileged forces raw ICMP sockets. Otherwise, when raw sockets are
+    // not permitted, Listen falls back to the unprivileged datagram ICMP
+    // sockets Linux offers to groups in net.ipv4.ping_group_range.
+    Privileged bool
+
+    // Source, if set, is the local address requests are sent from.
+    Source string
+}
+
+// Resolve looks up target in the address family selected by opts.
+func Resolve(target string, opts Options) (*net.IPAddr, error) {
+    network := opts.Network
+    if network == "" {
+        network = "ip"
+    }
+    if network != "ip" && network != "ip4" && network != "ip6" {
+        return nil, fmt.Errorf("unsupported network: %s", network)
+    }
+    return net.ResolveIPAddr(network, target)
+}
+
+// Session tracks the echo identifier and outstanding sequence numbers for one
+// probe run. Replies carrying another identifier, or a sequence number we are
+// no longer waiting for, are dropped. Requests may be sent while another
+// goroutine is receiving, but only one goroutine should receive at a time.
+type Session struct {
+    conn     *xicmp.PacketConn
+    v6       bool
+    datagram bool
+    src      net.IP
+    ID       int
+
+    mu      sync.Mutex
+    seq     int
+    pending map[int]bool
+
+    // flow is set by KeepFlow, and size by SetSize.
+    flow bool
+    size int
+}
+
+// Listen opens an ICMP socket of the right family for destAddr: ICMP for
+// IPv4 destinations and ICMPv6 for IPv6 ones.
+func Listen(destAddr *net.IPAddr, opts Options) (*Session, error) {
+    v6 := destAddr.IP.To4() == nil
+    network, dgramNetwork, address := "ip4:icmp", "udp4", "0.0.0.0"
+    if v6 {
+        network, dgramNetwork, address = "ip6:ipv6-icmp", "udp6", "::"
+    }
+
+    var src net.IP
+    if opts.Source != "" {
+        family := "IPv4"
+        if v6 {
+            family = "IPv6"
+        }
+        src = net.ParseIP(opts.Source)
+        if src == nil || (src.To4() == nil) != v6 {
+            return nil, fmt.Errorf("source address %s is not an %s address", opts.Source, family)
+        }
+        address = src.String()
+    }
+
+    datagram := false
+    conn, err := xicmp.ListenPacket(network, address)
+    if err != nil && !opts.Privileged && errors.Is(err, os.ErrPermission) {
+        var dgramErr error
+        conn, dgramErr = xicmp.ListenPacket(dgramNetwork, address)
+        if dgramErr != nil {
+            return nil, fmt.Errorf("%w (unprivileged ICMP is not available either: %v)", err, dgramErr)
+        }
+        datagram = true
+    } else if err != nil {
+        return nil, err
+    }
+
+    s := &Session{
+        conn:     conn,
+        v6:       v6,
+        datagram: datagram,
+        ID:       int(atomic.AddUint32(&nextID, 1) & 0xffff),
+        pending:  make(map[int]bool),
+    }
+    // Ask for the TTL of incoming packets so callers can report it. Not every
+    // platform supports this, and nothing depends on it, so errors are ignored.
+    if v6 {
+        conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+    } else {
+        conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+    }
+    if datagram {
+        // The kernel replaces the echo identifier with the socket's local
+        // port on the way out and only hands us replies carrying it.
+        s.ID = conn.LocalAddr().(*net.UDPAddr).Port
+    }
+    if v6 && src != nil {
+        s.src = src
+    } else if v6 {
+        // The ICMPv6 checksum covers a pseudo-header that includes our own
+        // address, so work out which one the kernel will send from.
+        s.src, err = SourceAddress(destAddr)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return s, nil
+}
+
+func (s *Session) Close() error {
+    return s.conn.Close()
+}
+
+// IPv6 reports whether the session speaks ICMPv6.
+func (s *Session) IPv6() bool {
+    return s.v6
+}
+
+// Datagram reports whether the session fell back to an unprivileged
+// datagram socket. Such sockets only receive echo replies; ICMP errors from
+// intermediate routers never reach them.
+func (s *Session) Datagram() bool {
+    return s.datagram
+}
+
+// SetTTL sets the IPv4 TTL or IPv6 hop limit of outgoing requests.
+func (s *Session) SetTTL(ttl int) error {
+    if s.v6 {
+        return s.conn.IPv6PacketConn().SetHopLimit(ttl)
+    }
+    return s.conn.IPv4PacketConn().SetTTL(ttl)
+}
+
+// SetTOS sets the IPv4 type of service or IPv6 traffic class of outgoing
+// requests.
+func (s *Session) SetTOS(tos int) error {
+    if s.v6 {
+        return s.conn.IPv6PacketConn().SetTrafficClass(tos)
+    }
+    return s.conn.IPv4PacketConn().SetTOS(tos)
+}
+
+// SetSize pads later requests with zeros to carry n bytes of payload after
+// the echo header.
+func (s *Session) SetSize(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.size = n
+}
+
+// KeepFlow makes every later request look like the same flow to load
+// balancers, which hash the identifier and checksum where a TCP or UDP
+// packet has its ports. Requests carry id as their identifier, or the
+// session's own if id is zero, and a payload word that cancels the sequence
+// number out of the checksum, so only the sequence number tells them apart.
+// Call it before sending any requests. It has no effect on datagram
+// sockets, where the kernel picks the identifier.
+func (s *Session) KeepFlow(id int) {
+    if s.datagram {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if id != 0 {
+        s.ID = id & 0xffff
+    }
+    s.flow = true
+}
+
+// SendICMPRequest sends an echo request with the next sequence number and
+// returns that sequence number.
+func (s *Session) SendICMPRequest(destAddr *net.IPAddr) (int, error) {
+    s.mu.Lock()
+    seq := s.seq & 0xffff
+    s.seq++
+    // Mark it outstanding before it goes out, in case the reply beats us.
+    s.pending[seq] = true
+    flow, size := s.flow, s.size
+    s.mu.Unlock()
+
     msg := make([]byte, 8)
     msg[0] = 8 // Echo request
+    if s.v6 {
+        msg[0] = byte(ipv6.ICMPTypeEchoRequest)
+    }
     msg[1] = 0 // Code 0
     msg[2] = 0 // Checksum placeholder
     msg[3] = 0 // Checksum placeholder
+    msg[4] = byte(s.ID >> 8)
+    msg[5] = byte(s.ID & 0xff)
     msg[6] = byte(seq >> 8)
     msg[7] = byte(seq & 0xff)
+    if flow {
+        // seq plus its one's complement sums to zero in the checksum.
+        msg = binary.BigEndian.AppendUint16(msg, ^uint16(seq))
+    }
+    if pad := 8 + size - len(msg); pad > 0 {
+        msg = append(msg, make([]byte, pad)...)
+    }
 
-    csum := Checksum(msg)
+    var csum uint16
+    if s.v6 {
+        csum = Checksum6(s.src, destAddr.IP, msg)
+    } else {
+        csum = Checksum(msg)
+    }
     msg[2] = byte(csum >> 8)
     msg[3] = byte(csum & 0xff)
 
-    _, err := conn.WriteTo(msg, nil, destAddr)
-    return err
+    if _, err := s.conn.WriteTo(msg, s.socketAddr(destAddr)); err != nil {
+        s.Forget(seq)
+        return seq, err
+    }
+    return seq, nil
+}
+
+// Reply describes an echo reply matched to this session.
+type Reply struct {
+    Seq   int
+    TTL   int // IPv4 TTL or IPv6 hop limit, 0 if the kernel didn't say
+    Bytes int
+    Addr  net.Addr
+}
+
+// ReceiveICMPReply waits up to timeout for an echo reply matching this
+// session. If an ICMP error about one of our requests arrives first, it is
+// returned as an *Error. Anything else that arrives on the socket in the
+// meantime is discarded. It returns ctx.Err() as soon as ctx is done.
+func (s *Session) ReceiveICMPReply(ctx context.Context, timeout time.Duration) (*Reply, error) {
+    if err := s.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+        return nil, err
+    }
+    // Registered after the deadline is set, so a cancellation can only ever
+    // pull it in, never be overwritten by it.
+    stop := context.AfterFunc(ctx, func() {
+        s.conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    buf := make([]byte, 1500)
+    for {
+        n, ttl, src, err := s.readMessage(buf)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+            return nil, err
+        }
+        seq, icmpErr, err := s.match(buf[:n], src)
+        if err != nil || !s.claim(seq) {
+            continue
+        }
+        if icmpErr != nil {
+            return nil, icmpErr
+        }
+        return &Reply{Seq: seq, TTL: ttl, Bytes: n, Addr: src}, nil
+    }
+}
+
+// readMessage reads one ICMP message along with the TTL or hop limit it
+// arrived with.
+func (s *Session) readMessage(b []byte) (int, int, net.Addr, error) {
+    if s.v6 {
+        n, cm, src, err := s.conn.IPv6PacketConn().ReadFrom(b)
+        if err != nil || cm == nil {
+            return n, 0, src, err
+        }
+        return n, cm.HopLimit, src, nil
+    }
+    n, cm, src, err := s.conn.IPv4PacketConn().ReadFrom(b)
+    if err != nil || cm == nil {
+        return n, 0, src, err
+    }
+    return n, cm.TTL, src, nil
+}
+
+// socketAddr converts destAddr into the address type the socket expects.
+func (s *Session) socketAddr(destAddr *net.IPAddr) net.Addr {
+    if s.datagram {
+        return &net.UDPAddr{IP: destAddr.IP, Zone: destAddr.Zone}
+    }
+    return destAddr
+}
+
+// Forget stops waiting for seq, so a late reply to it is dropped rather than
+// being mistaken for an answer to a later request.
+func (s *Session) Forget(seq int) {
+    s.claim(seq)
 }
 
-func ReceiveICMPReply(conn *ipv4.PacketConn, timeout time.Duration) error {
-    conn.SetReadDeadline(time.Now().Add(timeout))
-    reply := make([]byte, 20+8)
-    _, _, _, err := conn.ReadFrom(reply)
-    return err
+// claim marks seq as answered, reporting whether it was still outstanding.
+func (s *Session) claim(seq int) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.pending[seq] {
+        return false
+    }
+    delete(s.pending, seq)
+    return true
+}
+
+func (s *Session) outstanding(seq int) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.pending[seq]
+}
+
+// match checks whether b is an echo reply to one of our outstanding requests,
+// or an ICMP error about one, and returns the request's sequence number. For
+// errors it also returns the decoded message.
+func (s *Session) match(b []byte, src net.Addr) (int, *Error, error) {
+    proto, replyType := protocolICMP, xicmp.Type(ipv4.ICMPTypeEchoReply)
+    if s.v6 {
+        proto, replyType = protocolIPv6ICMP, ipv6.ICMPTypeEchoReply
+    }
+    msg, err := xicmp.ParseMessage(proto, b)
+    if err != nil {
+        return 0, nil, err
+    }
+    if msg.Type != replyType {
+        icmpErr, quoted := decodeError(s.v6, msg, b)
+        if icmpErr == nil {
+            return 0, nil, fmt.Errorf("unexpected ICMP type %v", msg.Type)
+        }
+        seq, err := s.matchQuoted(quoted)
+        if err != nil {
+            return 0, nil, err
+        }
+        icmpErr.Seq = seq
+        icmpErr.From = src
+        return seq, icmpErr, nil
+    }
+    echo, ok := msg.Body.(*xicmp.Echo)
+    if !ok {
+        return 0, nil, errors.New("malformed echo reply")
+    }
+    if echo.ID != s.ID {
+        return 0, nil, fmt.Errorf("echo identifier %d belongs to another session", echo.ID)
+    }
+    if !s.outstanding(echo.Seq) {
+        return 0, nil, fmt.Errorf("unexpected echo sequence %d", echo.Seq)
+    }
+    return echo.Seq, nil, nil
+}
+
+// SourceAddress returns the local address the kernel would use to reach dst.
+// Connecting a UDP socket sends nothing; it only performs the route lookup.
+func SourceAddress(dst *net.IPAddr) (net.IP, error) {
+    network := "udp4"
+    if dst.IP.To4() == nil {
+        network = "udp6"
+    }
+    conn, err := net.DialUDP(network, nil, &net.UDPAddr{IP: dst.IP, Port: 9, Zone: dst.Zone})
+    if err != nil {
+        return nil, fmt.Errorf("failed to find source address: %w", err)
+    }
+    defer conn.Close()
+    return conn.LocalAddr().(*net.UDPAddr).IP, nil
 }
 
 func Checksum(data []byte) uint16 {
@@ -44,3 +406,15 @@ func Checksum(data []byte) uint16 {
     }
     return ^uint16(sum)
 }
+
+// Checksum6 computes the ICMPv6 checksum of data, which unlike ICMP for IPv4
+// also covers the IPv6 pseudo-header described in RFC 8200 section 8.1.
+func Checksum6(src, dst net.IP, data []byte) uint16 {
+    b := make([]byte, 0, 40+len(data))
+    b = append(b, src.To16()...)
+    b = append(b, dst.To16()...)
+    b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+    b = append(b, 0, 0, 0, protocolIPv6ICMP)
+    b = append(b, data...)
+    return Checksum(b)
+}
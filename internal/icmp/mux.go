@@ -0,0 +1,135 @@
+package icmp
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+// Mux shares one Session between many concurrent probes. A single goroutine
+// reads every reply off the socket and hands it to whichever probe is
+// waiting on its sequence number.
+type Mux struct {
+    session *Session
+    cancel  context.CancelFunc
+    done    chan struct{}
+
+    mu      sync.Mutex
+    waiters map[int]chan muxResult
+    err     error // set once the receiver has stopped
+}
+
+type muxResult struct {
+    reply *Reply
+    err   error
+    at    time.Time
+}
+
+// NewMux starts demultiplexing replies on session. The session must not be
+// read from by anything else until the Mux is closed.
+func NewMux(session *Session) *Mux {
+    ctx, cancel := context.WithCancel(context.Background())
+    m := &Mux{
+        session: session,
+        cancel:  cancel,
+        done:    make(chan struct{}),
+        waiters: make(map[int]chan muxResult),
+    }
+    go m.receive(ctx)
+    return m
+}
+
+// Close stops the receiver. It does not close the session.
+func (m *Mux) Close() {
+    m.cancel()
+    <-m.done
+}
+
+// Probe sends one echo request to destAddr and waits up to timeout for the
+// answer. It returns the sequence number the request went out with (-1 if it
+// couldn't be sent), and the reply and its round trip time, an *Error if an
+// ICMP error came back instead, or os.ErrDeadlineExceeded if nothing did.
+func (m *Mux) Probe(ctx context.Context, destAddr *net.IPAddr, timeout time.Duration) (int, *Reply, time.Duration, error) {
+    ch := make(chan muxResult, 1)
+
+    // Hold the lock across the send so the receiver can't look for our
+    // waiter before it is registered.
+    m.mu.Lock()
+    if m.err != nil {
+        m.mu.Unlock()
+        return -1, nil, 0, m.err
+    }
+    start := time.Now()
+    seq, err := m.session.SendICMPRequest(destAddr)
+    if err != nil {
+        m.mu.Unlock()
+        return -1, nil, 0, err
+    }
+    m.waiters[seq] = ch
+    m.mu.Unlock()
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    select {
+    case res := <-ch:
+        return seq, res.reply, res.at.Sub(start), res.err
+    case <-timer.C:
+        err = os.ErrDeadlineExceeded
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+
+    m.mu.Lock()
+    delete(m.waiters, seq)
+    m.mu.Unlock()
+    m.session.Forget(seq)
+    return seq, nil, 0, err
+}
+
+func (m *Mux) receive(ctx context.Context) {
+    defer close(m.done)
+    for {
+        reply, err := m.session.ReceiveICMPReply(ctx, time.Second)
+        at := time.Now()
+
+        var seq int
+        var icmpErr *Error
+        switch {
+        case err == nil:
+            seq = reply.Seq
+        case errors.As(err, &icmpErr):
+            seq = icmpErr.Seq
+        case errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil:
+            continue
+        default:
+            if ctx.Err() != nil {
+                err = net.ErrClosed
+            }
+            m.stop(err)
+            return
+        }
+
+        m.mu.Lock()
+        ch, ok := m.waiters[seq]
+        delete(m.waiters, seq)
+        m.mu.Unlock()
+        if ok {
+            ch <- muxResult{reply: reply, err: err, at: at}
+        }
+    }
+}
+
+// stop fails every waiting probe with err and refuses new ones.
+func (m *Mux) stop(err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.err = err
+    for seq, ch := range m.waiters {
+        ch <- muxResult{err: err}
+        delete(m.waiters, seq)
+    }
+}
@@ -1,50 +1,45 @@
 package latency
 
 import (
+    "context"
     "fmt"
-    "net"
     "time"
 
-    "golang.org/x/net/ipv4"
-    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/ping"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
 )
 
-func AnalyzeLatency(target string, count int, timeout time.Duration) (string, error) {
-    destAddr, err := net.ResolveIPAddr("ip4", target)
-    if err != nil {
-        return "", fmt.Errorf("failed to resolve target: %w", err)
+// LatencyStats holds the round trip times observed to a target. Samples only
+// contains answered probes; Sent counts every probe that went out.
+type LatencyStats struct {
+    Target  string          `json:"target"`
+    Sent    int             `json:"sent"`
+    RTT     stats.Summary   `json:"rtt"`
+    Samples []time.Duration `json:"samples"`
+}
+
+func (s *LatencyStats) String() string {
+    if len(s.Samples) == 0 {
+        return fmt.Sprintf("Latency to %s: no replies to %d probes (100%% loss)", s.Target, s.Sent)
     }
+    return fmt.Sprintf("Latency to %s (%d of %d probes answered):\n%s",
+        s.Target, len(s.Samples), s.Sent, s.RTT)
+}
 
-    conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+// AnalyzeLatency probes target o.Count times and summarises the round trip
+// times of the answered probes.
+func AnalyzeLatency(target string, o ping.Options) (*LatencyStats, error) {
+    ps, err := ping.Ping(context.Background(), target, o)
     if err != nil {
-        return "", fmt.Errorf("failed to listen on packet: %w", err)
+        return nil, err
     }
-    defer conn.Close()
-
-    pconn := ipv4.NewPacketConn(conn)
-    var minRTT, maxRTT, totalRTT time.Duration
-    var packetsRecv int
 
-    for i := 0; i < count; i++ {
-        start := time.Now()
-        if err := icmp.SendICMPRequest(pconn, destAddr, i); err != nil {
-            return "", err
+    ls := &LatencyStats{Target: target, Sent: ps.Sent}
+    for _, s := range ps.Samples {
+        if s.Received {
+            ls.Samples = append(ls.Samples, s.RTT)
         }
-        if err := icmp.ReceiveICMPReply(pconn, timeout); err != nil {
-            continue // Count as a lost packet
-        }
-        RTT := time.Since(start)
-        if packetsRecv == 0 || RTT < minRTT {
-            minRTT = RTT
-        }
-        if RTT > maxRTT {
-            maxRTT = RTT
-        }
-        totalRTT += RTT
-        packetsRecv++
     }
-
-    avgRTT := totalRTT / time.Duration(packetsRecv)
-    return fmt.Sprintf("Latency to %s: Avg %v, Max %v, Min %v",
-        target, avgRTT, maxRTT, minRTT), nil
+    ls.RTT = ps.RTT
+    return ls, nil
 }
@@ -1,41 +1,55 @@
 package packetloss
 
 import (
+    "context"
     "fmt"
-    "net"
-    "time"
 
-    "golang.org/x/net/ipv4"
-    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/ping"
 )
 
-func DetectPacketLoss(target string, count int, timeout time.Duration) (string, error) {
-    destAddr, err := net.ResolveIPAddr("ip4", target)
-    if err != nil {
-        return "", fmt.Errorf("failed to resolve target: %w", err)
-    }
-
-    conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
-    if err != nil {
-        return "", fmt.Errorf("failed to listen on packet: %w", err)
-    }
-    defer conn.Close()
+// LossStats counts how many probes to a target went unanswered. Duplicates
+// and Reordered are only counted for UDP probes.
+type LossStats struct {
+    Target     string `json:"target"`
+    Sent       int    `json:"sent"`
+    Received   int    `json:"received"`
+    Duplicates int    `json:"duplicates,omitempty"`
+    Reordered  int    `json:"reordered,omitempty"`
+}
 
-    pconn := ipv4.NewPacketConn(conn)
-    var packetsSent, packetsRecv int
+// Lost returns the number of unanswered probes.
+func (s *LossStats) Lost() int {
+    return s.Sent - s.Received
+}
 
-    for i := 0; i < count; i++ {
-        if err := icmp.SendICMPRequest(pconn, destAddr, i); err != nil {
-            return "", err
-        }
-        if err := icmp.ReceiveICMPReply(pconn, timeout); err != nil {
-            continue // Count as a lost packet
-        }
-        packetsRecv++
-        packetsSent++
+// Loss returns the percentage of unanswered probes.
+func (s *LossStats) Loss() float64 {
+    if s.Sent == 0 {
+        return 0
     }
+    return float64(s.Lost()) / float64(s.Sent) * 100
+}
 
-    packetLoss := float64(packetsSent-packetsRecv) / float64(packetsSent) * 100
+func (s *LossStats) String() string {
+    if s.Duplicates > 0 || s.Reordered > 0 {
+        return fmt.Sprintf("Packet loss to %s: %.2f%% (Sent: %d, Received: %d, Lost: %d, Duplicates: %d, Reordered: %d)",
+            s.Target, s.Loss(), s.Sent, s.Received, s.Lost(), s.Duplicates, s.Reordered)
+    }
     return fmt.Sprintf("Packet loss to %s: %.2f%% (Sent: %d, Received: %d, Lost: %d)",
-        target, packetLoss, packetsSent, packetsRecv, packetsSent-packetsRecv), nil
+        s.Target, s.Loss(), s.Sent, s.Received, s.Lost())
+}
+
+// DetectPacketLoss probes target o.Count times and counts the answers.
+func DetectPacketLoss(target string, o ping.Options) (*LossStats, error) {
+    ps, err := ping.Ping(context.Background(), target, o)
+    if err != nil {
+        return nil, err
+    }
+    return &LossStats{
+        Target:     target,
+        Sent:       ps.Sent,
+        Received:   ps.Received,
+        Duplicates: ps.Duplicates,
+        Reordered:  ps.Reordered,
+    }, nil
 }
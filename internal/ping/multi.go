@@ -0,0 +1,198 @@
+package ping
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// MultiOptions controls a PingMany run. Count, Interval, Timeout, ICMP, Proto
+// and Port apply to each target; OnSample is not used.
+type MultiOptions struct {
+    Options
+
+    // Concurrency is how many targets are probed at once.
+    Concurrency int
+
+    // Rate caps the requests sent per second across all targets.
+    Rate int
+}
+
+// PingMany pings every target concurrently, fping style, and returns their
+// statistics in the order given. All targets of one address family share a
+// single ICMP socket. A target that cannot be resolved gets a PingStats with
+// Error set rather than failing the whole run.
+func PingMany(ctx context.Context, targets []string, o MultiOptions) ([]*PingStats, error) {
+    if err := o.Validate(); err != nil {
+        return nil, err
+    }
+    if o.Concurrency <= 0 {
+        o.Concurrency = 1
+    }
+
+    results := make([]*PingStats, len(targets))
+    // Both keyed by IPv6. Each mux is closed before its session, as its
+    // receiver reads from the session until then.
+    sessions := make(map[bool]*icmp.Session)
+    muxes := make(map[bool]*icmp.Mux)
+    defer func() {
+        for v6, mux := range muxes {
+            mux.Close()
+            sessions[v6].Close()
+        }
+    }()
+
+    type job struct {
+        index    int
+        destAddr *net.IPAddr
+        mux      *icmp.Mux
+    }
+    var jobs []job
+    for i, target := range targets {
+        results[i] = &PingStats{Target: target}
+        destAddr, err := icmp.Resolve(target, o.ICMP)
+        if err != nil {
+            results[i].Error = fmt.Sprintf("failed to resolve target: %v", err)
+            continue
+        }
+        results[i].Addr = destAddr.String()
+        results[i].Proto, results[i].Port = o.Proto, o.Port
+        if o.Proto != "icmp" {
+            jobs = append(jobs, job{index: i, destAddr: destAddr})
+            continue
+        }
+
+        v6 := destAddr.IP.To4() == nil
+        mux, ok := muxes[v6]
+        if !ok {
+            session, err := icmp.Listen(destAddr, o.ICMP)
+            if err != nil {
+                return nil, fmt.Errorf("failed to listen on packet: %w", err)
+            }
+            mux = icmp.NewMux(session)
+            sessions[v6], muxes[v6] = session, mux
+        }
+        jobs = append(jobs, job{index: i, destAddr: destAddr, mux: mux})
+    }
+
+    // A shared ticker paces sends across every target.
+    var tick <-chan time.Time
+    if o.Rate > 0 {
+        ticker := time.NewTicker(time.Second / time.Duration(o.Rate))
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    sem := make(chan struct{}, o.Concurrency)
+    var wg sync.WaitGroup
+    for _, j := range jobs {
+        select {
+        case sem <- struct{}{}:
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+            break
+        }
+        wg.Add(1)
+        go func(j job) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            pingOne(ctx, j.mux, j.destAddr, results[j.index], o.Options, tick)
+        }(j)
+    }
+    wg.Wait()
+
+    return results, nil
+}
+
+// pingOne runs o.Count probes to destAddr through mux, recording them in ps.
+// TCP and UDP probes need no mux, and are paced only by the concurrency
+// limit.
+func pingOne(ctx context.Context, mux *icmp.Mux, destAddr *net.IPAddr, ps *PingStats, o Options, tick <-chan time.Time) {
+    defer summarize(ps)
+    switch o.Proto {
+    case "tcp":
+        pingTCP(ctx, destAddr, ps, o)
+        return
+    case "udp":
+        if err := pingUDP(ctx, destAddr, ps, o); err != nil {
+            ps.Error = err.Error()
+        }
+        return
+    }
+
+    for i := 0; o.Count == 0 || i < o.Count; i++ {
+        if i > 0 && o.Interval > 0 {
+            select {
+            case <-time.After(o.Interval):
+            case <-ctx.Done():
+                return
+            }
+        }
+        if tick != nil {
+            select {
+            case <-tick:
+            case <-ctx.Done():
+                return
+            }
+        }
+
+        seq, reply, rtt, err := mux.Probe(ctx, destAddr, o.Timeout)
+        if ctx.Err() != nil {
+            return
+        }
+        ps.Sent++
+        sample := Sample{Seq: seq}
+        var icmpErr *icmp.Error
+        switch {
+        case err == nil:
+            sample.Received = true
+            sample.RTT = rtt
+            sample.TTL = reply.TTL
+            sample.Bytes = reply.Bytes
+        case errors.As(err, &icmpErr):
+            ps.Errors++
+            sample.Error = icmpErr.Message()
+            if icmpErr.From != nil {
+                sample.From = icmpErr.From.String()
+            }
+        case errors.Is(err, os.ErrDeadlineExceeded):
+        default:
+            ps.Error = err.Error()
+            ps.Samples = append(ps.Samples, sample)
+            return
+        }
+        ps.Samples = append(ps.Samples, sample)
+    }
+}
+
+// FormatTable renders one line per target with its loss and RTT figures.
+func FormatTable(results []*PingStats) string {
+    var sb strings.Builder
+    w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "TARGET\tADDRESS\tSENT\tRECV\tLOSS\tMIN\tAVG\tMAX\tMDEV")
+    for _, r := range results {
+        if r.Error != "" && r.Sent == 0 {
+            fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t%s\n", r.Target, r.Addr, r.Error)
+            continue
+        }
+        if !r.Alive() {
+            fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.0f%%\t-\t-\t-\t-\n", r.Target, r.Addr, r.Sent, r.Received, r.Loss())
+            continue
+        }
+        fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.0f%%\t%.3f\t%.3f\t%.3f\t%.3f\n",
+            r.Target, r.Addr, r.Sent, r.Received, r.Loss(),
+            stats.Milliseconds(r.RTT.Min), stats.Milliseconds(r.RTT.Mean), stats.Milliseconds(r.RTT.Max), stats.Milliseconds(r.RTT.MDev))
+    }
+    w.Flush()
+    return sb.String()
+}
@@ -1,53 +1,272 @@
 package ping
 
 import (
+    "context"
+    "errors"
     "fmt"
-    "net"
+    "os"
+    "strings"
     "time"
 
-    "golang.org/x/net/ipv4"
     "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
 )
 
-func Ping(target string, count int, timeout time.Duration) (string, error) {
-    destAddr, err := net.ResolveIPAddr("ip4", target)
+// Sample is the outcome of a single echo request.
+type Sample struct {
+    Seq      int           `json:"seq"`
+    Received bool          `json:"received"`
+    RTT      time.Duration `json:"rtt"`
+    TTL      int           `json:"ttl,omitempty"`
+    Bytes    int           `json:"bytes,omitempty"`
+
+    // Error describes the ICMP error, such as Destination Host Unreachable,
+    // that came back instead of a reply, and From is who sent it.
+    Error string `json:"error,omitempty"`
+    From  string `json:"from,omitempty"`
+}
+
+// PingStats summarises a ping run. RTT figures only cover received replies.
+type PingStats struct {
+    Target   string        `json:"target"`
+    Addr     string        `json:"addr"`
+    Proto    string        `json:"proto"`
+    Port     int           `json:"port,omitempty"`
+    Sent     int           `json:"sent"`
+    Received int           `json:"received"`
+    Errors   int           `json:"errors"`
+    RTT      stats.Summary `json:"rtt"`
+    Samples  []Sample      `json:"samples"`
+
+    // Duplicates and Reordered count UDP replies that arrived more than
+    // once or after a later probe's reply. ICMP and TCP probes never set
+    // them.
+    Duplicates int `json:"duplicates,omitempty"`
+    Reordered  int `json:"reordered,omitempty"`
+
+    // Error is set when the target could not be probed at all, for example
+    // because its name did not resolve. Only PingMany reports errors this
+    // way; Ping returns them.
+    Error string `json:"error,omitempty"`
+}
+
+// Alive reports whether the target answered at least once.
+func (s *PingStats) Alive() bool {
+    return s.Received > 0
+}
+
+// Lost returns the number of requests that went unanswered.
+func (s *PingStats) Lost() int {
+    return s.Sent - s.Received
+}
+
+// Loss returns the percentage of requests that went unanswered.
+func (s *PingStats) Loss() float64 {
+    if s.Sent == 0 {
+        return 0
+    }
+    return float64(s.Lost()) / float64(s.Sent) * 100
+}
+
+func (s *PingStats) String() string {
+    errs := ""
+    if s.Errors > 0 {
+        errs = fmt.Sprintf(", Errors = %d", s.Errors)
+    }
+    if s.Duplicates > 0 || s.Reordered > 0 {
+        errs += fmt.Sprintf(", Duplicates = %d, Reordered = %d", s.Duplicates, s.Reordered)
+    }
+    name := s.Target
+    switch s.Proto {
+    case "tcp":
+        name = fmt.Sprintf("%s (TCP port %d)", s.Target, s.Port)
+    case "udp":
+        name = fmt.Sprintf("%s (UDP port %d)", s.Target, s.Port)
+    }
+    if s.Received == 0 {
+        return fmt.Sprintf("Ping statistics for %s: Packets: Sent = %d, Received = 0, Lost = %d (100%% loss)%s",
+            name, s.Sent, s.Lost(), errs)
+    }
+    return fmt.Sprintf("Ping statistics for %s: Packets: Sent = %d, Received = %d, Lost = %d (%.2f%% loss)%s,\nApproximate round trip times in milli-seconds:\n%s",
+        name, s.Sent, s.Received, s.Lost(), s.Loss(), errs, s.RTT)
+}
+
+// Options controls a ping run.
+type Options struct {
+    // Count is the number of requests to send. Zero keeps going until the
+    // context is cancelled.
+    Count int
+
+    // Interval is the time between requests. Zero sends the next request as
+    // soon as the previous one has been answered or has timed out.
+    Interval time.Duration
+
+    // Timeout is how long to wait for each reply.
+    Timeout time.Duration
+
+    ICMP icmp.Options
+
+    // Proto selects the probe: "icmp" (the default) for echo requests,
+    // "tcp" to time TCP handshakes with Port, for hosts that filter ICMP, or
+    // "udp" to send datagrams to a "gonetdiag reflect" server on Port.
+    Proto string
+    Port  int
+
+    // OnSample, if set, is called for every reply and every timeout as they
+    // happen, for callers that want to show progress.
+    OnSample func(Sample)
+}
+
+// Validate checks the protocol settings, defaulting Proto to "icmp".
+func (o *Options) Validate() error {
+    switch o.Proto {
+    case "":
+        o.Proto = "icmp"
+    case "icmp":
+    case "tcp", "udp":
+        if o.Port <= 0 || o.Port > 65535 {
+            return fmt.Errorf("invalid %s port: %d", strings.ToUpper(o.Proto), o.Port)
+        }
+    default:
+        return fmt.Errorf("unsupported ping protocol: %s", o.Proto)
+    }
+    return nil
+}
+
+// Ping probes target and summarises the replies. When ctx is cancelled it
+// stops and returns the statistics gathered so far.
+func Ping(ctx context.Context, target string, o Options) (*PingStats, error) {
+    if err := o.Validate(); err != nil {
+        return nil, err
+    }
+    destAddr, err := icmp.Resolve(target, o.ICMP)
     if err != nil {
-        return "", fmt.Errorf("failed to resolve target: %w", err)
+        return nil, fmt.Errorf("failed to resolve target: %w", err)
+    }
+
+    ps := &PingStats{Target: target, Addr: destAddr.String(), Proto: o.Proto, Port: o.Port}
+    switch o.Proto {
+    case "tcp":
+        pingTCP(ctx, destAddr, ps, o)
+        summarize(ps)
+        return ps, nil
+    case "udp":
+        if err := pingUDP(ctx, destAddr, ps, o); err != nil {
+            return nil, err
+        }
+        summarize(ps)
+        return ps, nil
     }
 
-    conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+    session, err := icmp.Listen(destAddr, o.ICMP)
     if err != nil {
-        return "", fmt.Errorf("failed to listen on packet: %w", err)
+        return nil, fmt.Errorf("failed to listen on packet: %w", err)
     }
-    defer conn.Close()
+    defer session.Close()
 
-    pconn := ipv4.NewPacketConn(conn)
-    var minRTT, maxRTT, totalRTT time.Duration
-    var packetsSent, packetsRecv int
+    // Outstanding requests, by sequence number, with the index of their
+    // sample and the time they were sent.
+    type request struct {
+        index  int
+        sentAt time.Time
+    }
+    outstanding := make(map[int]request)
+    nextSend := time.Now()
+
+    for ctx.Err() == nil {
+        now := time.Now()
+        more := o.Count == 0 || ps.Sent < o.Count
+        canSend := more && (o.Interval > 0 || len(outstanding) == 0)
+
+        if canSend && !now.Before(nextSend) {
+            seq, err := session.SendICMPRequest(destAddr)
+            if err != nil {
+                return nil, err
+            }
+            outstanding[seq] = request{index: len(ps.Samples), sentAt: now}
+            ps.Samples = append(ps.Samples, Sample{Seq: seq})
+            ps.Sent++
+            nextSend = now.Add(o.Interval)
+            continue
+        }
 
-    for i := 0; i < count; i++ {
-        start := time.Now()
-        if err := icmp.SendICMPRequest(pconn, destAddr, i); err != nil {
-            return "", err
+        // Expire requests that have waited too long, and work out when the
+        // next one will.
+        wake := nextSend
+        if !canSend {
+            wake = now.Add(o.Timeout)
+        }
+        for seq, req := range outstanding {
+            expiry := req.sentAt.Add(o.Timeout)
+            if !now.Before(expiry) {
+                session.Forget(seq)
+                delete(outstanding, seq)
+                if o.OnSample != nil {
+                    o.OnSample(ps.Samples[req.index])
+                }
+                continue
+            }
+            if expiry.Before(wake) {
+                wake = expiry
+            }
         }
-        if err := icmp.ReceiveICMPReply(pconn, timeout); err != nil {
-            continue // Count as a lost packet
+        if !more && len(outstanding) == 0 {
+            break
         }
-        RTT := time.Since(start)
-        if packetsRecv == 0 || RTT < minRTT {
-            minRTT = RTT
+
+        reply, err := session.ReceiveICMPReply(ctx, wake.Sub(now))
+        var icmpErr *icmp.Error
+        if errors.As(err, &icmpErr) {
+            // The request was answered, just not by the target. It still
+            // counts as lost, but say why rather than waiting for a timeout.
+            req, ok := outstanding[icmpErr.Seq]
+            if !ok {
+                continue
+            }
+            delete(outstanding, icmpErr.Seq)
+            ps.Errors++
+            sample := &ps.Samples[req.index]
+            sample.Error = icmpErr.Message()
+            if icmpErr.From != nil {
+                sample.From = icmpErr.From.String()
+            }
+            if o.OnSample != nil {
+                o.OnSample(*sample)
+            }
+            continue
         }
-        if RTT > maxRTT {
-            maxRTT = RTT
+        if err != nil {
+            if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+                continue
+            }
+            return nil, err
+        }
+        req, ok := outstanding[reply.Seq]
+        if !ok {
+            continue
+        }
+        delete(outstanding, reply.Seq)
+        sample := &ps.Samples[req.index]
+        sample.Received = true
+        sample.RTT = time.Since(req.sentAt)
+        sample.TTL = reply.TTL
+        sample.Bytes = reply.Bytes
+        if o.OnSample != nil {
+            o.OnSample(*sample)
         }
-        totalRTT += RTT
-        packetsRecv++
-        packetsSent++
     }
 
-    packetLoss := float64(packetsSent-packetsRecv) / float64(packetsSent) * 100
-    avgRTT := totalRTT / time.Duration(packetsRecv)
+    summarize(ps)
+    return ps, nil
+}
 
-    return fmt.Sprintf("Ping statistics for %s: Packets: Sent = %d, Received = %d, Lost = %d (%.2f%% loss),\nApproximate round trip times in milli-seconds:\nMinimum = %vms, Maximum = %vms, Average = %vms",
-        target, packetsSent, packetsRecv, packetsSent-packetsRecv, packetLoss, minRTT.Milliseconds(), maxRTT.Milliseconds(), avgRTT.Milliseconds()), nil
+func summarize(ps *PingStats) {
+    var rtts []time.Duration
+    for _, s := range ps.Samples {
+        if s.Received {
+            rtts = append(rtts, s.RTT)
+        }
+    }
+    ps.Received = len(rtts)
+    ps.RTT = stats.Summarize(rtts)
 }
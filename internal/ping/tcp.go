@@ -0,0 +1,78 @@
+package ping
+
+import (
+    "context"
+    "errors"
+    "net"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+// TCPProbe measures how long a TCP handshake with address takes. A refused
+// connection counts as an answer too: the RST proves the host is up, and it
+// comes back just as fast as a SYN-ACK would. No privileges are needed.
+func TCPProbe(ctx context.Context, address string, timeout time.Duration) (time.Duration, error) {
+    dialer := net.Dialer{Timeout: timeout}
+    start := time.Now()
+    conn, err := dialer.DialContext(ctx, "tcp", address)
+    rtt := time.Since(start)
+    if err == nil {
+        conn.Close()
+        return rtt, nil
+    }
+    if errors.Is(err, syscall.ECONNREFUSED) {
+        return rtt, nil
+    }
+    return 0, err
+}
+
+// pingTCP is Ping for Proto "tcp": it times TCP handshakes with destAddr on
+// o.Port instead of exchanging ICMP echoes.
+func pingTCP(ctx context.Context, destAddr *net.IPAddr, ps *PingStats, o Options) {
+    address := net.JoinHostPort(destAddr.String(), strconv.Itoa(o.Port))
+
+    for seq := 0; o.Count == 0 || seq < o.Count; seq++ {
+        if seq > 0 && o.Interval > 0 {
+            select {
+            case <-time.After(o.Interval):
+            case <-ctx.Done():
+                return
+            }
+        }
+
+        rtt, err := TCPProbe(ctx, address, o.Timeout)
+        if ctx.Err() != nil {
+            return
+        }
+        ps.Sent++
+        sample := Sample{Seq: seq}
+        var netErr net.Error
+        switch {
+        case err == nil:
+            sample.Received = true
+            sample.RTT = rtt
+        case errors.As(err, &netErr) && netErr.Timeout():
+            // No answer at all; count it as lost.
+        default:
+            // Something answered, but not the target, for example a router
+            // saying there is no route to it.
+            ps.Errors++
+            sample.Error = tcpErrorMessage(err)
+        }
+        ps.Samples = append(ps.Samples, sample)
+        if o.OnSample != nil {
+            o.OnSample(sample)
+        }
+    }
+}
+
+// tcpErrorMessage strips the dial error down to its cause, such as "no route
+// to host", to match how ICMP errors are reported.
+func tcpErrorMessage(err error) string {
+    var errno syscall.Errno
+    if errors.As(err, &errno) {
+        return errno.Error()
+    }
+    return err.Error()
+}
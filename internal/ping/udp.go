@@ -0,0 +1,244 @@
+package ping
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "syscall"
+    "time"
+
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// ReflectPort is the UDP port "gonetdiag reflect" listens on by default.
+const ReflectPort = 7007
+
+// udpMagic starts every UDP probe, so the reflector only echoes our own
+// datagrams and stray traffic is never mistaken for a reply.
+var udpMagic = []byte("GNDU")
+
+// udpHeaderLen is the magic, a 32-bit sequence number and the 64-bit send
+// time in nanoseconds since the epoch.
+const udpHeaderLen = 16
+
+func encodeUDPProbe(seq int, sentAt time.Time) []byte {
+    b := make([]byte, udpHeaderLen)
+    copy(b, udpMagic)
+    binary.BigEndian.PutUint32(b[4:], uint32(seq))
+    binary.BigEndian.PutUint64(b[8:], uint64(sentAt.UnixNano()))
+    return b
+}
+
+func decodeUDPProbe(b []byte) (seq int, ok bool) {
+    if len(b) < udpHeaderLen || !bytes.Equal(b[:4], udpMagic) {
+        return 0, false
+    }
+    return int(binary.BigEndian.Uint32(b[4:])), true
+}
+
+// Reflect echoes every UDP probe arriving on conn back to its sender until
+// ctx is cancelled or conn is closed. Anything that isn't a probe is
+// dropped. Replies leave from the address the probe was sent to, since
+// clients ignore datagrams from any other, which matters when conn is bound
+// to a wildcard address. A probe that can't be echoed, say because its
+// source was spoofed, is reported to logf, if set, and the rest carry on.
+func Reflect(ctx context.Context, conn net.PacketConn, logf func(format string, args ...interface{})) error {
+    if logf == nil {
+        logf = func(string, ...interface{}) {}
+    }
+    stop := context.AfterFunc(ctx, func() {
+        conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    v4 := false
+    if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+        v4 = true
+    }
+    var p4 *ipv4.PacketConn
+    var p6 *ipv6.PacketConn
+    if v4 {
+        p4 = ipv4.NewPacketConn(conn)
+        p4.SetControlMessage(ipv4.FlagDst, true)
+    } else {
+        p6 = ipv6.NewPacketConn(conn)
+        p6.SetControlMessage(ipv6.FlagDst, true)
+    }
+
+    buf := make([]byte, 65535)
+    for {
+        var n int
+        var addr net.Addr
+        var dst net.IP
+        var err error
+        if v4 {
+            var cm *ipv4.ControlMessage
+            n, cm, addr, err = p4.ReadFrom(buf)
+            if cm != nil {
+                dst = cm.Dst
+            }
+        } else {
+            var cm *ipv6.ControlMessage
+            n, cm, addr, err = p6.ReadFrom(buf)
+            if cm != nil {
+                dst = cm.Dst
+            }
+        }
+        if err != nil {
+            if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+                return nil
+            }
+            logf("failed to read probe: %v", err)
+            // Don't spin on an error that keeps coming back.
+            select {
+            case <-time.After(100 * time.Millisecond):
+            case <-ctx.Done():
+                return nil
+            }
+            continue
+        }
+        if _, ok := decodeUDPProbe(buf[:n]); !ok {
+            continue
+        }
+
+        if v4 {
+            _, err = p4.WriteTo(buf[:n], &ipv4.ControlMessage{Src: dst}, addr)
+        } else if dst.To4() != nil {
+            // An IPv4 probe on a dual-stack socket. Linux sends it down the
+            // IPv4 path, which only honours an IPv4 source option.
+            _, err = ipv4.NewPacketConn(conn).WriteTo(buf[:n], &ipv4.ControlMessage{Src: dst}, addr)
+        } else {
+            _, err = p6.WriteTo(buf[:n], &ipv6.ControlMessage{Src: dst}, addr)
+        }
+        if err != nil {
+            logf("failed to reflect probe to %v: %v", addr, err)
+        }
+    }
+}
+
+// pingUDP is Ping for Proto "udp": it sends sequence-numbered datagrams to a
+// reflector on o.Port and matches the echoes. Unlike ICMP, a probe can come
+// back more than once or overtake an earlier one, and both are counted.
+func pingUDP(ctx context.Context, destAddr *net.IPAddr, ps *PingStats, o Options) error {
+    address := net.JoinHostPort(destAddr.String(), strconv.Itoa(o.Port))
+    conn, err := net.Dial("udp", address)
+    if err != nil {
+        return fmt.Errorf("failed to dial reflector: %w", err)
+    }
+    defer conn.Close()
+
+    stop := context.AfterFunc(ctx, func() {
+        conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    // Outstanding probes by sequence number, which is also the index of
+    // their sample, with the time they were sent.
+    outstanding := make(map[int]time.Time)
+    highest := -1
+    nextSend := time.Now()
+    buf := make([]byte, 1500)
+
+    for ctx.Err() == nil {
+        now := time.Now()
+        more := o.Count == 0 || ps.Sent < o.Count
+        canSend := more && (o.Interval > 0 || len(outstanding) == 0)
+
+        if canSend && !now.Before(nextSend) {
+            seq := ps.Sent
+            if _, err := conn.Write(encodeUDPProbe(seq, now)); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+                return fmt.Errorf("failed to send probe: %w", err)
+            }
+            outstanding[seq] = now
+            ps.Samples = append(ps.Samples, Sample{Seq: seq})
+            ps.Sent++
+            nextSend = now.Add(o.Interval)
+            continue
+        }
+
+        wake := nextSend
+        if !canSend {
+            wake = now.Add(o.Timeout)
+        }
+        for seq, sentAt := range outstanding {
+            expiry := sentAt.Add(o.Timeout)
+            if !now.Before(expiry) {
+                delete(outstanding, seq)
+                if o.OnSample != nil {
+                    o.OnSample(ps.Samples[seq])
+                }
+                continue
+            }
+            if expiry.Before(wake) {
+                wake = expiry
+            }
+        }
+        if !more && len(outstanding) == 0 {
+            break
+        }
+
+        conn.SetReadDeadline(wake)
+        n, err := conn.Read(buf)
+        if errors.Is(err, syscall.ECONNREFUSED) {
+            // An ICMP port unreachable: nothing listens on the port. Pin it
+            // on the oldest outstanding probe.
+            oldest := -1
+            for seq := range outstanding {
+                if oldest < 0 || seq < oldest {
+                    oldest = seq
+                }
+            }
+            if oldest < 0 {
+                continue
+            }
+            delete(outstanding, oldest)
+            ps.Errors++
+            sample := &ps.Samples[oldest]
+            sample.Error = "Destination Port Unreachable"
+            sample.From = destAddr.String()
+            if o.OnSample != nil {
+                o.OnSample(*sample)
+            }
+            continue
+        }
+        if err != nil {
+            if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+                continue
+            }
+            return fmt.Errorf("failed to read reply: %w", err)
+        }
+
+        seq, ok := decodeUDPProbe(buf[:n])
+        if !ok || seq >= len(ps.Samples) {
+            continue
+        }
+        sample := &ps.Samples[seq]
+        if sample.Received {
+            ps.Duplicates++
+            continue
+        }
+        sentAt, ok := outstanding[seq]
+        if !ok {
+            continue // answered after it timed out
+        }
+        delete(outstanding, seq)
+        if seq < highest {
+            ps.Reordered++
+        } else {
+            highest = seq
+        }
+        sample.Received = true
+        sample.RTT = time.Since(sentAt)
+        sample.Bytes = n
+        if o.OnSample != nil {
+            o.OnSample(*sample)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,78 @@
+package ping
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestPingUDPReflector(t *testing.T) {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    reflected := make(chan error, 1)
+    go func() { reflected <- Reflect(ctx, conn, t.Logf) }()
+    defer func() {
+        cancel()
+        if err := <-reflected; err != nil {
+            t.Errorf("Reflect: %v", err)
+        }
+    }()
+
+    dest := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+    ps := &PingStats{}
+    o := Options{
+        Count:    5,
+        Interval: 10 * time.Millisecond,
+        Timeout:  time.Second,
+        Proto:    "udp",
+        Port:     conn.LocalAddr().(*net.UDPAddr).Port,
+    }
+    if err := pingUDP(context.Background(), dest, ps, o); err != nil {
+        t.Fatalf("pingUDP: %v", err)
+    }
+    summarize(ps)
+
+    if ps.Sent != o.Count || ps.Received != o.Count {
+        t.Errorf("sent %d and received %d, want %d of each", ps.Sent, ps.Received, o.Count)
+    }
+    if loss := ps.Loss(); loss != 0 {
+        t.Errorf("loss = %v%%, want 0", loss)
+    }
+    if ps.Errors != 0 || ps.Duplicates != 0 {
+        t.Errorf("errors = %d, duplicates = %d, want none", ps.Errors, ps.Duplicates)
+    }
+    for _, s := range ps.Samples {
+        if !s.Received || s.RTT <= 0 {
+            t.Errorf("sample %d: received = %v, RTT = %v", s.Seq, s.Received, s.RTT)
+        }
+    }
+    if ps.RTT.Min <= 0 || ps.RTT.Max < ps.RTT.Min {
+        t.Errorf("RTT summary %+v", ps.RTT)
+    }
+}
+
+func TestDecodeUDPProbe(t *testing.T) {
+    probe := encodeUDPProbe(42, time.Now())
+    if seq, ok := decodeUDPProbe(probe); !ok || seq != 42 {
+        t.Errorf("decodeUDPProbe(probe) = %d, %v, want 42, true", seq, ok)
+    }
+
+    garbage := append([]byte("XXXX"), probe[4:]...)
+    for name, b := range map[string][]byte{
+        "empty":        nil,
+        "magic only":   []byte("GNDU"),
+        "short":        probe[:udpHeaderLen-1],
+        "wrong magic":  garbage,
+        "random bytes": []byte("this is not a probe at all"),
+    } {
+        if _, ok := decodeUDPProbe(b); ok {
+            t.Errorf("decodeUDPProbe(%s) succeeded", name)
+        }
+    }
+}
@@ -5,29 +5,36 @@ import (
     "encoding/json"
     "fmt"
     "os"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/bandwidth"
+    "github.com/Dyst0rti0n/gonetdiag/internal/bufferbloat"
+    "github.com/Dyst0rti0n/gonetdiag/internal/latency"
+    "github.com/Dyst0rti0n/gonetdiag/internal/packetloss"
+    "github.com/Dyst0rti0n/gonetdiag/internal/ping"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+    "github.com/Dyst0rti0n/gonetdiag/internal/sweep"
+    "github.com/Dyst0rti0n/gonetdiag/internal/traceroute"
 )
 
+// Report collects the results of every diagnostic run against a target. A
+// nil section means that test was not run.
 type Report struct {
-    Target        string `json:"target"`
-    PingResult    string `json:"ping_result"`
-    TraceResult   string `json:"trace_result"`
-    BandwidthResult string `json:"bandwidth_result"`
-    LatencyResult string `json:"latency_result"`
-    PacketLossResult string `json:"packet_loss_result"`
+    Target      string                 `json:"target"`
+    Ping        *ping.PingStats        `json:"ping,omitempty"`
+    Trace       []traceroute.Hop       `json:"trace,omitempty"`
+    MTR         *traceroute.MTRResult  `json:"mtr,omitempty"`
+    Upload      *bandwidth.Measurement `json:"upload,omitempty"`
+    Download    *bandwidth.Measurement `json:"download,omitempty"`
+    Latency     *latency.LatencyStats  `json:"latency,omitempty"`
+    PacketLoss  *packetloss.LossStats  `json:"packet_loss,omitempty"`
+    Subnet      *sweep.Result          `json:"subnet,omitempty"`
+    Bufferbloat *bufferbloat.Result    `json:"bufferbloat,omitempty"`
 }
 
-func GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult string) error {
-    report := Report{
-        Target: target,
-        PingResult: pingResult,
-        TraceResult: traceResult,
-        BandwidthResult: bandwidthResult,
-        LatencyResult: latencyResult,
-        PacketLossResult: packetLossResult,
-    }
-
+func GenerateReport(report *Report) error {
     // Save JSON report
-    jsonFile, err := os.Create(fmt.Sprintf("%s_report.json", target))
+    jsonFile, err := os.Create(fmt.Sprintf("%s_report.json", report.Target))
     if err != nil {
         return fmt.Errorf("failed to create JSON report file: %w", err)
     }
@@ -39,7 +46,7 @@ func GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyRes
     }
 
     // Save CSV report
-    csvFile, err := os.Create(fmt.Sprintf("%s_report.csv", target))
+    csvFile, err := os.Create(fmt.Sprintf("%s_report.csv", report.Target))
     if err != nil {
         return fmt.Errorf("failed to create CSV report file: %w", err)
     }
@@ -48,12 +55,93 @@ func GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyRes
     csvWriter := csv.NewWriter(csvFile)
     defer csvWriter.Flush()
 
-    if err := csvWriter.Write([]string{"Target", "PingResult", "TraceResult", "BandwidthResult", "LatencyResult", "PacketLossResult"}); err != nil {
+    if err := csvWriter.Write([]string{"Target", "PingResult", "TraceResult", "BandwidthResult", "LatencyResult", "PacketLossResult",
+        "MeanRTTms", "MedianRTTms", "P95RTTms", "P99RTTms", "JitterMs", "LossPercent", "SubnetInventory",
+        "BufferbloatResult", "BufferbloatGrade", "DownloadAddedLatencyMs", "UploadAddedLatencyMs", "MTRResult"}); err != nil {
         return fmt.Errorf("failed to write CSV header: %w", err)
     }
-    if err := csvWriter.Write([]string{target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult}); err != nil {
+    if err := csvWriter.Write(report.record()); err != nil {
         return fmt.Errorf("failed to write CSV record: %w", err)
     }
 
     return nil
 }
+
+// record renders each section as text for the CSV report.
+func (r *Report) record() []string {
+    var pingResult, bandwidthResult, latencyResult, packetLossResult string
+    if r.Ping != nil {
+        pingResult = r.Ping.String()
+    }
+    if r.Upload != nil {
+        bandwidthResult = r.Upload.String()
+    }
+    if r.Download != nil {
+        if bandwidthResult != "" {
+            bandwidthResult += "\n"
+        }
+        bandwidthResult += r.Download.String()
+    }
+    if r.Latency != nil {
+        latencyResult = r.Latency.String()
+    }
+    if r.PacketLoss != nil {
+        packetLossResult = r.PacketLoss.String()
+    }
+    var subnetResult string
+    if r.Subnet != nil {
+        subnetResult = r.Subnet.String()
+    }
+    record := append([]string{r.Target, pingResult, traceroute.Format(r.Trace), bandwidthResult, latencyResult, packetLossResult},
+        r.rttRecord()...)
+    record = append(record, subnetResult)
+    record = append(record, r.bufferbloatRecord()...)
+    var mtrResult string
+    if r.MTR != nil {
+        mtrResult = r.MTR.String()
+    }
+    return append(record, mtrResult)
+}
+
+// bufferbloatRecord renders the bufferbloat test, its grade and the latency
+// each direction's load added. Columns for directions that weren't loaded,
+// or for which no pings were answered, are left empty.
+func (r *Report) bufferbloatRecord() []string {
+    if r.Bufferbloat == nil {
+        return make([]string, 4)
+    }
+    added := func(p *bufferbloat.Phase) string {
+        if p == nil || p.Received == 0 {
+            return ""
+        }
+        return fmt.Sprintf("%.3f", stats.Milliseconds(p.Added))
+    }
+    return []string{r.Bufferbloat.String(), r.Bufferbloat.Grade, added(r.Bufferbloat.Download), added(r.Bufferbloat.Upload)}
+}
+
+// rttRecord renders the headline RTT statistics as separate CSV columns,
+// preferring the latency test's larger sample over ping's. The RTT columns
+// are left empty when nothing answered.
+func (r *Report) rttRecord() []string {
+    var summary stats.Summary
+    var replies int
+    var loss float64
+    switch {
+    case r.Latency != nil:
+        summary, replies = r.Latency.RTT, len(r.Latency.Samples)
+        if r.Latency.Sent > 0 {
+            loss = float64(r.Latency.Sent-replies) / float64(r.Latency.Sent) * 100
+        }
+    case r.Ping != nil:
+        summary, replies, loss = r.Ping.RTT, r.Ping.Received, r.Ping.Loss()
+    default:
+        return make([]string, 6)
+    }
+    if replies == 0 {
+        return []string{"", "", "", "", "", "100"}
+    }
+    ms := func(d time.Duration) string {
+        return fmt.Sprintf("%.3f", stats.Milliseconds(d))
+    }
+    return []string{ms(summary.Mean), ms(summary.Median), ms(summary.P95), ms(summary.P99), ms(summary.Jitter), fmt.Sprintf("%.2f", loss)}
+}
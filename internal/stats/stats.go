@@ -0,0 +1,175 @@
+package stats
+
+import (
+    "fmt"
+    "math"
+    "math/rand/v2"
+    "sort"
+    "time"
+)
+
+// Summary describes a series of round trip times. The zero value is what an
+// empty series summarises to, so a run in which every probe was lost simply
+// has no figures rather than bogus ones.
+type Summary struct {
+    Min    time.Duration `json:"min"`
+    Mean   time.Duration `json:"mean"`
+    Median time.Duration `json:"median"`
+    Max    time.Duration `json:"max"`
+
+    // StdDev is the sample standard deviation. MDev is the population
+    // standard deviation that ping(8) prints as "mdev".
+    StdDev time.Duration `json:"stddev"`
+    MDev   time.Duration `json:"mdev"`
+
+    P90 time.Duration `json:"p90"`
+    P95 time.Duration `json:"p95"`
+    P99 time.Duration `json:"p99"`
+
+    // Jitter is the RFC 3550 interarrival jitter of the series.
+    Jitter time.Duration `json:"jitter"`
+}
+
+func (s Summary) String() string {
+    return fmt.Sprintf("Minimum = %.3fms, Maximum = %.3fms, Average = %.3fms, Median = %.3fms, Mdev = %.3fms\nP90 = %.3fms, P95 = %.3fms, P99 = %.3fms, Jitter = %.3fms",
+        Milliseconds(s.Min), Milliseconds(s.Max), Milliseconds(s.Mean), Milliseconds(s.Median), Milliseconds(s.MDev),
+        Milliseconds(s.P90), Milliseconds(s.P95), Milliseconds(s.P99), Milliseconds(s.Jitter))
+}
+
+// Milliseconds converts d to fractional milliseconds, the unit RTTs are
+// usually quoted in.
+func Milliseconds(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+// Summarize computes a Summary of rtts, which must be in the order the
+// probes were sent for Jitter to be meaningful.
+func Summarize(rtts []time.Duration) Summary {
+    var s Summary
+    if len(rtts) == 0 {
+        return s
+    }
+
+    sorted := append([]time.Duration(nil), rtts...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+    var total float64
+    for _, rtt := range rtts {
+        total += float64(rtt)
+    }
+    mean := total / float64(len(rtts))
+
+    var squares float64
+    for _, rtt := range rtts {
+        d := float64(rtt) - mean
+        squares += d * d
+    }
+
+    s.Min = sorted[0]
+    s.Max = sorted[len(sorted)-1]
+    s.Mean = time.Duration(mean)
+    s.Median = Percentile(sorted, 50)
+    s.MDev = time.Duration(math.Sqrt(squares / float64(len(rtts))))
+    if len(rtts) > 1 {
+        s.StdDev = time.Duration(math.Sqrt(squares / float64(len(rtts)-1)))
+    }
+    s.P90 = Percentile(sorted, 90)
+    s.P95 = Percentile(sorted, 95)
+    s.P99 = Percentile(sorted, 99)
+    s.Jitter = Jitter(rtts)
+    return s
+}
+
+// Percentile returns the p-th percentile (0-100) of sorted, interpolating
+// linearly between the closest ranks.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    if p <= 0 {
+        return sorted[0]
+    }
+    if p >= 100 {
+        return sorted[len(sorted)-1]
+    }
+    rank := p / 100 * float64(len(sorted)-1)
+    lower := int(math.Floor(rank))
+    upper := int(math.Ceil(rank))
+    frac := rank - float64(lower)
+    return sorted[lower] + time.Duration(frac*float64(sorted[upper]-sorted[lower]))
+}
+
+// Jitter returns the interarrival jitter of RFC 3550 section 6.4.1: a running
+// estimate, smoothed by 1/16, of how much consecutive transit times differ.
+func Jitter(rtts []time.Duration) time.Duration {
+    var j float64
+    for i := 1; i < len(rtts); i++ {
+        d := math.Abs(float64(rtts[i] - rtts[i-1]))
+        j += (d - j) / 16
+    }
+    return time.Duration(j)
+}
+
+// RunningSample is how many values a Running keeps to estimate percentiles
+// from.
+const RunningSample = 1024
+
+// Running summarises a series too long to keep, one value at a time. Min,
+// Max, Mean, the deviations and Jitter are exact; the median and other
+// percentiles come from a uniform sample of RunningSample values, so they are
+// exact only until that many have been added. The zero value is empty.
+type Running struct {
+    n        int
+    min, max time.Duration
+    last     time.Duration
+    mean, m2 float64 // Welford's running variance
+    jitter   float64
+    sample   []time.Duration
+}
+
+// Add adds d to the end of the series.
+func (r *Running) Add(d time.Duration) {
+    r.n++
+    if r.n == 1 {
+        r.min, r.max = d, d
+    } else {
+        r.min, r.max = min(r.min, d), max(r.max, d)
+        r.jitter += (math.Abs(float64(d-r.last)) - r.jitter) / 16
+    }
+    r.last = d
+    delta := float64(d) - r.mean
+    r.mean += delta / float64(r.n)
+    r.m2 += delta * (float64(d) - r.mean)
+
+    // Reservoir sampling keeps every value seen so far equally likely to be
+    // in the sample.
+    if len(r.sample) < RunningSample {
+        r.sample = append(r.sample, d)
+    } else if i := rand.IntN(r.n); i < RunningSample {
+        r.sample[i] = d
+    }
+}
+
+// Summary returns the Summary of the series so far.
+func (r *Running) Summary() Summary {
+    var s Summary
+    if r.n == 0 {
+        return s
+    }
+    sorted := append([]time.Duration(nil), r.sample...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+    s.Min = r.min
+    s.Max = r.max
+    s.Mean = time.Duration(r.mean)
+    s.Median = Percentile(sorted, 50)
+    s.MDev = time.Duration(math.Sqrt(r.m2 / float64(r.n)))
+    if r.n > 1 {
+        s.StdDev = time.Duration(math.Sqrt(r.m2 / float64(r.n-1)))
+    }
+    s.P90 = Percentile(sorted, 90)
+    s.P95 = Percentile(sorted, 95)
+    s.P99 = Percentile(sorted, 99)
+    s.Jitter = time.Duration(r.jitter)
+    return s
+}
@@ -0,0 +1,158 @@
+package stats
+
+import (
+    "testing"
+    "time"
+)
+
+const ms = time.Millisecond
+
+// near reports whether got is within a nanosecond of want, which is all the
+// float arithmetic behind the deviations can be trusted to.
+func near(got, want time.Duration) bool {
+    d := got - want
+    return d >= -1 && d <= 1
+}
+
+func TestSummarizeEmpty(t *testing.T) {
+    if s := Summarize(nil); s != (Summary{}) {
+        t.Errorf("Summarize(nil) = %+v, want the zero Summary", s)
+    }
+    if s := Summarize([]time.Duration{}); s != (Summary{}) {
+        t.Errorf("Summarize(empty) = %+v, want the zero Summary", s)
+    }
+}
+
+func TestSummarizeSingle(t *testing.T) {
+    got := Summarize([]time.Duration{7 * ms})
+    want := Summary{Min: 7 * ms, Mean: 7 * ms, Median: 7 * ms, Max: 7 * ms, P90: 7 * ms, P95: 7 * ms, P99: 7 * ms}
+    if got != want {
+        t.Errorf("Summarize([7ms]) = %+v, want %+v", got, want)
+    }
+}
+
+func TestSummarize(t *testing.T) {
+    // Out of order, so the summary mustn't depend on the series being
+    // sorted, except for Jitter which follows the order given.
+    got := Summarize([]time.Duration{30 * ms, 10 * ms, 40 * ms, 20 * ms})
+
+    for _, c := range []struct {
+        name      string
+        got, want time.Duration
+    }{
+        {"Min", got.Min, 10 * ms},
+        {"Max", got.Max, 40 * ms},
+        {"Mean", got.Mean, 25 * ms},
+        {"Median", got.Median, 25 * ms},
+        {"P90", got.P90, 37 * ms},
+        {"P95", got.P95, 38500 * time.Microsecond},
+        {"P99", got.P99, 39700 * time.Microsecond},
+        // Deviations of 15, 5, 5 and 15ms square to 500ms² in all.
+        {"MDev", got.MDev, 11180340 * time.Nanosecond},   // sqrt(500/4)
+        {"StdDev", got.StdDev, 12909944 * time.Nanosecond}, // sqrt(500/3)
+        {"Jitter", got.Jitter, Jitter([]time.Duration{30 * ms, 10 * ms, 40 * ms, 20 * ms})},
+    } {
+        if !near(c.got, c.want) {
+            t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+        }
+    }
+}
+
+func TestMDevAndStdDev(t *testing.T) {
+    // ping(8)'s mdev divides by n and the sample standard deviation by n-1,
+    // so they differ most on short series.
+    s := Summarize([]time.Duration{10 * ms, 20 * ms})
+    if !near(s.MDev, 5*ms) {
+        t.Errorf("MDev = %v, want 5ms", s.MDev)
+    }
+    if !near(s.StdDev, 7071068*time.Nanosecond) { // sqrt(50)ms
+        t.Errorf("StdDev = %v, want 7.071068ms", s.StdDev)
+    }
+    if s.StdDev <= s.MDev {
+        t.Errorf("StdDev %v is not above MDev %v", s.StdDev, s.MDev)
+    }
+}
+
+func TestPercentile(t *testing.T) {
+    sorted := []time.Duration{1 * ms, 2 * ms, 3 * ms, 4 * ms, 5 * ms}
+    for _, c := range []struct {
+        p    float64
+        want time.Duration
+    }{
+        {-5, 1 * ms},
+        {0, 1 * ms},
+        {10, 1400 * time.Microsecond},
+        {25, 2 * ms},
+        {50, 3 * ms},
+        {62.5, 3500 * time.Microsecond},
+        {100, 5 * ms},
+        {150, 5 * ms},
+    } {
+        if got := Percentile(sorted, c.p); got != c.want {
+            t.Errorf("Percentile(%v) = %v, want %v", c.p, got, c.want)
+        }
+    }
+    if got := Percentile(nil, 50); got != 0 {
+        t.Errorf("Percentile of an empty series = %v, want 0", got)
+    }
+}
+
+func TestJitter(t *testing.T) {
+    for _, c := range []struct {
+        name   string
+        series []time.Duration
+        want   time.Duration
+    }{
+        {"empty", nil, 0},
+        {"single", []time.Duration{10 * ms}, 0},
+        {"steady", []time.Duration{10 * ms, 10 * ms, 10 * ms}, 0},
+        // J = 20/16 = 1.25ms, then 1.25 + (20-1.25)/16 = 2.421875ms.
+        {"alternating", []time.Duration{10 * ms, 30 * ms, 10 * ms}, 2421875 * time.Nanosecond},
+        // A rise and a fall of the same size count the same.
+        {"falling", []time.Duration{30 * ms, 10 * ms, 30 * ms}, 2421875 * time.Nanosecond},
+    } {
+        if got := Jitter(c.series); got != c.want {
+            t.Errorf("%s: Jitter = %v, want %v", c.name, got, c.want)
+        }
+    }
+}
+
+func TestRunning(t *testing.T) {
+    var r Running
+    if s := r.Summary(); s != (Summary{}) {
+        t.Errorf("empty Running summary = %+v, want the zero Summary", s)
+    }
+
+    // Within the sample, Running must agree with Summarize exactly, bar
+    // the rounding of its running deviations.
+    series := []time.Duration{30 * ms, 10 * ms, 40 * ms, 20 * ms, 25 * ms}
+    for _, d := range series {
+        r.Add(d)
+    }
+    got, want := r.Summary(), Summarize(series)
+    if !near(got.StdDev, want.StdDev) || !near(got.MDev, want.MDev) || !near(got.Mean, want.Mean) {
+        t.Errorf("deviations %v/%v/%v, want %v/%v/%v", got.Mean, got.StdDev, got.MDev, want.Mean, want.StdDev, want.MDev)
+    }
+    got.Mean, got.StdDev, got.MDev = want.Mean, want.StdDev, want.MDev
+    if got != want {
+        t.Errorf("Running summary = %+v, want %+v", got, want)
+    }
+}
+
+func TestRunningBounded(t *testing.T) {
+    var r Running
+    for i := 1; i <= 10*RunningSample; i++ {
+        r.Add(time.Duration(i) * time.Microsecond)
+    }
+    if len(r.sample) != RunningSample {
+        t.Errorf("kept %d values, want %d", len(r.sample), RunningSample)
+    }
+    s := r.Summary()
+    if s.Min != time.Microsecond || s.Max != 10*RunningSample*time.Microsecond {
+        t.Errorf("Min, Max = %v, %v", s.Min, s.Max)
+    }
+    // The median is estimated from the sample, so only roughly right.
+    if mid := 5 * RunningSample * time.Microsecond; s.Median < mid*8/10 || s.Median > mid*12/10 {
+        t.Errorf("Median = %v, want about %v", s.Median, mid)
+    }
+}
@@ -0,0 +1,148 @@
+package sweep
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/ping"
+    "github.com/Dyst0rti0n/gonetdiag/internal/targets"
+)
+
+// CommonPorts are tried by the TCP fallback when no ports are given. They
+// cover the services most hosts that drop ICMP still expose.
+var CommonPorts = []int{22, 80, 443, 445, 3389}
+
+// Host is a responder found by a sweep.
+type Host struct {
+    Addr   string        `json:"addr"`
+    Name   string        `json:"name,omitempty"`
+    Method string        `json:"method"` // "icmp" or "tcp/<port>"
+    RTT    time.Duration `json:"rtt"`
+}
+
+// Result is the inventory of a subnet: every host that answered, in address
+// order, and how many addresses were probed.
+type Result struct {
+    Network string `json:"network"`
+    Scanned int    `json:"scanned"`
+    Hosts   []Host `json:"hosts"`
+}
+
+func (r *Result) String() string {
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "Sweep of %s: %d of %d hosts up\n", r.Network, len(r.Hosts), r.Scanned)
+    if len(r.Hosts) == 0 {
+        return sb.String()
+    }
+    w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "ADDRESS\tNAME\tMETHOD\tRTT")
+    for _, h := range r.Hosts {
+        fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", h.Addr, h.Name, h.Method, h.RTT)
+    }
+    w.Flush()
+    return sb.String()
+}
+
+// Options controls a sweep.
+type Options struct {
+    Count       int // echo requests per host
+    Timeout     time.Duration
+    Concurrency int
+    Rate        int // echo requests per second across the sweep
+    ICMP        icmp.Options
+
+    // TCPPorts, if set, are tried with plain TCP connects on hosts that
+    // didn't answer ICMP. A refused connection still proves the host is up.
+    TCPPorts []int
+
+    // NoDNS skips the reverse lookups of responders.
+    NoDNS bool
+}
+
+// Sweep probes every host address in cidr and returns those that answered.
+func Sweep(ctx context.Context, cidr string, o Options) (*Result, error) {
+    hosts, err := targets.Hosts(cidr)
+    if err != nil {
+        return nil, err
+    }
+    if o.Concurrency <= 0 {
+        o.Concurrency = 1
+    }
+
+    pings, err := ping.PingMany(ctx, hosts, ping.MultiOptions{
+        Options:     ping.Options{Count: o.Count, Timeout: o.Timeout, ICMP: o.ICMP},
+        Concurrency: o.Concurrency,
+        Rate:        o.Rate,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    found := make([]*Host, len(hosts))
+    var silent []int
+    for i, p := range pings {
+        if p.Alive() {
+            found[i] = &Host{Addr: hosts[i], Method: "icmp", RTT: p.RTT.Min}
+        } else {
+            silent = append(silent, i)
+        }
+    }
+
+    sem := make(chan struct{}, o.Concurrency)
+    var wg sync.WaitGroup
+    if len(o.TCPPorts) > 0 {
+        for _, i := range silent {
+            wg.Add(1)
+            sem <- struct{}{}
+            go func(i int) {
+                defer wg.Done()
+                defer func() { <-sem }()
+                found[i] = probeTCP(ctx, hosts[i], o.TCPPorts, o.Timeout)
+            }(i)
+        }
+        wg.Wait()
+    }
+
+    result := &Result{Network: cidr, Scanned: len(hosts)}
+    for _, h := range found {
+        if h != nil {
+            result.Hosts = append(result.Hosts, *h)
+        }
+    }
+
+    if !o.NoDNS {
+        for i := range result.Hosts {
+            wg.Add(1)
+            sem <- struct{}{}
+            go func(h *Host) {
+                defer wg.Done()
+                defer func() { <-sem }()
+                if names, err := net.DefaultResolver.LookupAddr(ctx, h.Addr); err == nil && len(names) > 0 {
+                    h.Name = strings.TrimSuffix(names[0], ".")
+                }
+            }(&result.Hosts[i])
+        }
+        wg.Wait()
+    }
+
+    return result, ctx.Err()
+}
+
+// probeTCP tries each port in turn and returns the host as soon as one
+// either accepts the connection or actively refuses it.
+func probeTCP(ctx context.Context, addr string, ports []int, timeout time.Duration) *Host {
+    for _, port := range ports {
+        rtt, err := ping.TCPProbe(ctx, net.JoinHostPort(addr, strconv.Itoa(port)), timeout)
+        if err == nil {
+            return &Host{Addr: addr, Method: fmt.Sprintf("tcp/%d", port), RTT: rtt}
+        }
+    }
+    return nil
+}
@@ -0,0 +1,92 @@
+package targets
+
+import (
+    "bufio"
+    "fmt"
+    "math/big"
+    "net"
+    "os"
+    "strings"
+)
+
+// MaxHosts caps how many addresses a single CIDR range may expand to, so a
+// typo like /8 doesn't queue up sixteen million probes.
+const MaxHosts = 65536
+
+// Expand turns a list of target specifications into individual targets.
+// Hostnames and addresses are passed through; CIDR ranges become every host
+// address in the range.
+func Expand(specs []string) ([]string, error) {
+    var out []string
+    for _, spec := range specs {
+        if !strings.Contains(spec, "/") {
+            out = append(out, spec)
+            continue
+        }
+        hosts, err := Hosts(spec)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, hosts...)
+    }
+    return out, nil
+}
+
+// Hosts lists the host addresses in cidr. For IPv4 ranges wider than /31 the
+// network and broadcast addresses are left out.
+func Hosts(cidr string) ([]string, error) {
+    ip, ipnet, err := net.ParseCIDR(cidr)
+    if err != nil {
+        return nil, fmt.Errorf("invalid CIDR range %q: %w", cidr, err)
+    }
+    ones, bits := ipnet.Mask.Size()
+    if bits-ones > 16 {
+        return nil, fmt.Errorf("CIDR range %q has more than %d addresses", cidr, MaxHosts)
+    }
+    size := 1 << (bits - ones)
+
+    base := ip.Mask(ipnet.Mask)
+    if ip.To4() != nil {
+        base = base.To4()
+    }
+    first, last := 0, size-1
+    if ip.To4() != nil && size > 2 {
+        first, last = 1, size-2
+    }
+
+    hosts := make([]string, 0, last-first+1)
+    start := new(big.Int).SetBytes(base)
+    for i := first; i <= last; i++ {
+        n := new(big.Int).Add(start, big.NewInt(int64(i))).Bytes()
+        addr := make(net.IP, len(base))
+        copy(addr[len(addr)-len(n):], n)
+        hosts = append(hosts, addr.String())
+    }
+    return hosts, nil
+}
+
+// ReadFile reads targets from path, one per line. Blank lines and anything
+// after a '#' are ignored, and CIDR ranges are expanded.
+func ReadFile(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open targets file: %w", err)
+    }
+    defer f.Close()
+
+    var specs []string
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        for _, field := range strings.Fields(line) {
+            specs = append(specs, field)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read targets file: %w", err)
+    }
+    return Expand(specs)
+}
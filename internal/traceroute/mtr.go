@@ -0,0 +1,261 @@
+package traceroute
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
+)
+
+// MTROptions controls an mtr run.
+type MTROptions struct {
+    // Options controls the trace that discovers the path, and the probes
+    // sent along it afterwards. Queries and SimQueries only apply to the
+    // trace.
+    Options
+
+    // Cycles is the number of rounds to probe every hop in. Zero keeps
+    // going until the context is done.
+    Cycles int
+
+    // Interval is the time from the start of one round to the next, one
+    // second if zero.
+    Interval time.Duration
+
+    // OnRound, if set, is called with the running figures after each round.
+    OnRound func(*MTRResult)
+}
+
+// Router is one address that answered at a hop.
+type Router struct {
+    Addr string `json:"addr"`
+    Host string `json:"host"`
+}
+
+// HopStats accumulates the answers one hop gave over an mtr run. Best,
+// Worst, Avg and StdDev are zero until it has answered.
+type HopStats struct {
+    TTL      int      `json:"ttl"`
+    Routers  []Router `json:"routers,omitempty"`
+    Sent     int      `json:"sent"`
+    Received int      `json:"received"`
+
+    Last   time.Duration `json:"last"`
+    Best   time.Duration `json:"best"`
+    Worst  time.Duration `json:"worst"`
+    Avg    time.Duration `json:"avg"`
+    StdDev time.Duration `json:"stddev"`
+
+    // mean and m2 carry Welford's running variance, so a long run doesn't
+    // have to keep every RTT.
+    mean, m2 float64
+}
+
+// Loss returns the percentage of probes to the hop that went unanswered.
+func (h *HopStats) Loss() float64 {
+    if h.Sent == 0 {
+        return 0
+    }
+    return float64(h.Sent-h.Received) / float64(h.Sent) * 100
+}
+
+// add counts one probe to the hop and, if it was answered, its answer.
+func (h *HopStats) add(p Probe) {
+    h.Sent++
+    if p.Addr == "" {
+        return
+    }
+    known := false
+    for _, r := range h.Routers {
+        if r.Addr == p.Addr {
+            known = true
+            break
+        }
+    }
+    if !known {
+        h.Routers = append(h.Routers, Router{Addr: p.Addr, Host: p.Host})
+    }
+
+    h.Received++
+    h.Last = p.RTT
+    if h.Received == 1 || p.RTT < h.Best {
+        h.Best = p.RTT
+    }
+    if p.RTT > h.Worst {
+        h.Worst = p.RTT
+    }
+    d := float64(p.RTT) - h.mean
+    h.mean += d / float64(h.Received)
+    h.m2 += d * (float64(p.RTT) - h.mean)
+    h.Avg = time.Duration(h.mean)
+    if h.Received > 1 {
+        h.StdDev = time.Duration(math.Sqrt(h.m2 / float64(h.Received-1)))
+    }
+}
+
+// MTRResult is the running state of an mtr run: every hop's figures over the
+// rounds so far.
+type MTRResult struct {
+    Target string     `json:"target"`
+    FlowID int        `json:"flow_id"`
+    Cycles int        `json:"cycles"`
+    Hops   []HopStats `json:"hops"`
+}
+
+// String renders the hops as mtr's report table does, RTTs in milliseconds.
+// Routers beyond the first to answer at a hop get lines of their own.
+func (r *MTRResult) String() string {
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "%-44s %6s %5s %8s %8s %8s %8s %8s\n",
+        fmt.Sprintf("HOST: %s (flow ID %d)", r.Target, r.FlowID), "Loss%", "Snt", "Last", "Avg", "Best", "Worst", "StDev")
+    name := func(router Router) string {
+        if router.Host != router.Addr {
+            return fmt.Sprintf("%s (%s)", router.Host, router.Addr)
+        }
+        return router.Addr
+    }
+    for i := range r.Hops {
+        h := &r.Hops[i]
+        if len(h.Routers) == 0 {
+            fmt.Fprintf(&sb, "%3d. %-39s %5.1f%% %5d\n", h.TTL, "???", h.Loss(), h.Sent)
+            continue
+        }
+        fmt.Fprintf(&sb, "%3d. %-39s %5.1f%% %5d %8.3f %8.3f %8.3f %8.3f %8.3f\n",
+            h.TTL, name(h.Routers[0]), h.Loss(), h.Sent, stats.Milliseconds(h.Last), stats.Milliseconds(h.Avg),
+            stats.Milliseconds(h.Best), stats.Milliseconds(h.Worst), stats.Milliseconds(h.StdDev))
+        for _, router := range h.Routers[1:] {
+            fmt.Fprintf(&sb, "     %s\n", name(router))
+        }
+    }
+    return sb.String()
+}
+
+// MTR traces the route to target, then keeps probing every hop on it once a
+// round, as mtr does, accumulating each hop's loss and RTT figures. It
+// returns what it has when the context is done, unless that is before the
+// first round completes.
+func MTR(ctx context.Context, target string, o MTROptions) (*MTRResult, error) {
+    if o.Interval <= 0 {
+        o.Interval = time.Second
+    }
+    var err error
+    o.Options, err = o.Options.withDefaults()
+    if err != nil {
+        return nil, err
+    }
+
+    t, err := newTracer(target, o.Options)
+    if err != nil {
+        return nil, err
+    }
+    defer t.close()
+
+    trace := o.Options
+    trace.Queries = 1
+    hops, err := t.trace(ctx, trace)
+    if err != nil {
+        return nil, err
+    }
+    // Hops past the last to answer are just the trace running out of TTLs.
+    for len(hops) > 0 && hops[len(hops)-1].Received == 0 {
+        hops = hops[:len(hops)-1]
+    }
+    if len(hops) == 0 {
+        return nil, fmt.Errorf("no hops on the route to %s answered", target)
+    }
+
+    r := &MTRResult{Target: target, FlowID: t.prober.flowID(), Hops: make([]HopStats, len(hops))}
+    for i := range r.Hops {
+        r.Hops[i].TTL = hops[i].TTL
+    }
+    for o.Cycles == 0 || r.Cycles < o.Cycles {
+        start := time.Now()
+        probes, err := t.round(ctx, o.FirstTTL, len(hops), o.Wait)
+        if ctx.Err() != nil && r.Cycles > 0 {
+            return r, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        for i := range r.Hops {
+            r.Hops[i].add(probes[i])
+        }
+        r.Cycles++
+        if o.OnRound != nil {
+            o.OnRound(r)
+        }
+        if o.Cycles != 0 && r.Cycles == o.Cycles {
+            break
+        }
+        select {
+        case <-time.After(time.Until(start.Add(o.Interval))):
+        case <-ctx.Done():
+            return r, nil
+        }
+    }
+    return r, nil
+}
+
+// round sends one probe to each of the n TTLs from first at once and waits
+// up to wait for their answers. The probe to TTL first+i is returned at
+// index i, with an empty Addr if it went unanswered.
+func (t *tracer) round(ctx context.Context, first, n int, wait time.Duration) ([]Probe, error) {
+    probes := make([]Probe, n)
+    sent := make(map[int]time.Time, n)
+    ttls := make(map[int]int, n)
+    for ttl := first; ttl < first+n; ttl++ {
+        at := time.Now()
+        key, err := t.prober.send(ttl)
+        if err != nil {
+            return nil, err
+        }
+        sent[key], ttls[key] = at, ttl
+    }
+    // Whatever is still unanswered when the round ends is forgotten, so a
+    // late answer isn't counted towards the next one.
+    defer func() {
+        for key := range ttls {
+            t.prober.forget(key)
+        }
+    }()
+
+    deadline := time.Now().Add(wait)
+    for len(ttls) > 0 {
+        remaining := time.Until(deadline)
+        if remaining <= 0 {
+            break
+        }
+        a, err := t.prober.receive(ctx, remaining)
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        if errors.Is(err, os.ErrDeadlineExceeded) {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        ttl, ok := ttls[a.key]
+        if !ok {
+            continue
+        }
+        rtt := a.at.Sub(sent[a.key])
+        delete(ttls, a.key)
+        probe := Probe{Addr: a.from, RTT: rtt}
+        if a.unreachable != nil {
+            probe.Error = a.unreachable.Message()
+        }
+        probes[ttl-first] = probe
+    }
+    for i := range probes {
+        if probes[i].Addr != "" {
+            probes[i].Host = t.host(probes[i].Addr)
+        }
+    }
+    return probes, nil
+}
@@ -0,0 +1,542 @@
+package traceroute
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// Probe methods.
+const (
+    MethodICMP = "icmp"
+    MethodUDP  = "udp"
+    MethodTCP  = "tcp"
+)
+
+// DefaultUDPPort is the first destination port of UDP probes, as in classic
+// traceroute, and DefaultTCPPort the port TCP probes try to connect to.
+const (
+    DefaultUDPPort = 33434
+    DefaultTCPPort = 443
+)
+
+const (
+    protocolTCP = 6
+    protocolUDP = 17
+)
+
+// answer is what came back for one probe, identified by the key send
+// returned for it.
+type answer struct {
+    key  int
+    from string
+    at   time.Time
+
+    // reached is set when the destination itself answered.
+    reached bool
+
+    // unreachable is set when the answer says the destination cannot be
+    // reached.
+    unreachable *icmp.Error
+}
+
+// prober sends probes of one method with a given TTL and reads the answers
+// to them. Every probe of a prober belongs to the same flow, except where
+// the method varies it on purpose.
+type prober interface {
+    // send sends a probe with the given TTL and returns its key.
+    send(ttl int) (int, error)
+
+    // receive waits up to timeout for an answer to any probe still
+    // outstanding. It returns os.ErrDeadlineExceeded if none came.
+    receive(ctx context.Context, timeout time.Duration) (answer, error)
+
+    // forget stops waiting for the probe with key, so a late answer to it
+    // is dropped.
+    forget(key int)
+
+    // flowID returns what identifies the probes' flow: the ICMP identifier
+    // or the source port.
+    flowID() int
+
+    close() error
+}
+
+// newProber opens a prober for o.Method towards destAddr.
+func newProber(destAddr *net.IPAddr, o Options) (prober, error) {
+    switch o.Method {
+    case "", MethodICMP:
+        return newICMPProber(destAddr, o)
+    case MethodUDP:
+        return newUDPProber(destAddr, o)
+    case MethodTCP:
+        return newTCPProber(destAddr, o)
+    }
+    return nil, fmt.Errorf("unsupported traceroute method: %s", o.Method)
+}
+
+// icmpProber sends echo requests, which keep one identifier and checksum.
+type icmpProber struct {
+    session *icmp.Session
+    dest    *net.IPAddr
+}
+
+func newICMPProber(destAddr *net.IPAddr, o Options) (*icmpProber, error) {
+    // Datagram ICMP sockets never see time exceeded messages, so the
+    // intermediate hops would all be silent. Insist on a raw socket.
+    o.ICMP.Privileged = true
+    session, err := icmp.Listen(destAddr, o.ICMP)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on packet: %w", err)
+    }
+    session.KeepFlow(o.FlowID)
+    session.SetSize(o.Size)
+    if o.TOS != 0 {
+        if err := session.SetTOS(o.TOS); err != nil {
+            session.Close()
+            return nil, fmt.Errorf("failed to set TOS: %w", err)
+        }
+    }
+    return &icmpProber{session: session, dest: destAddr}, nil
+}
+
+func (p *icmpProber) send(ttl int) (int, error) {
+    if err := p.session.SetTTL(ttl); err != nil {
+        return 0, fmt.Errorf("failed to set TTL: %w", err)
+    }
+    seq, err := p.session.SendICMPRequest(p.dest)
+    if err != nil {
+        return 0, fmt.Errorf("failed to send ICMP request: %w", err)
+    }
+    return seq, nil
+}
+
+func (p *icmpProber) receive(ctx context.Context, timeout time.Duration) (answer, error) {
+    seq, addr, unreachable, err := receiveAddress(ctx, p.session, timeout)
+    if err != nil {
+        return answer{}, err
+    }
+    return answer{key: seq, from: addr, at: time.Now(), reached: addr == p.dest.String(), unreachable: unreachable}, nil
+}
+
+func (p *icmpProber) forget(key int) { p.session.Forget(key) }
+func (p *icmpProber) flowID() int    { return p.session.ID }
+func (p *icmpProber) close() error   { return p.session.Close() }
+
+// transportProber holds what UDP and TCP probes share: a raw ICMP socket the
+// errors about them come back on, read in the background, and the probes
+// still waiting for an answer.
+type transportProber struct {
+    dest    *net.IPAddr
+    errs    *icmp.Session
+    ctx     context.Context
+    cancel  context.CancelFunc
+    answers chan answer
+    wg      sync.WaitGroup
+
+    mu      sync.Mutex
+    pending map[int]bool
+}
+
+func newTransportProber(destAddr *net.IPAddr, o Options) (*transportProber, error) {
+    o.ICMP.Privileged = true
+    errs, err := icmp.Listen(destAddr, o.ICMP)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen for ICMP errors: %w", err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    return &transportProber{
+        dest:    destAddr,
+        errs:    errs,
+        ctx:     ctx,
+        cancel:  cancel,
+        answers: make(chan answer, 64),
+        pending: make(map[int]bool),
+    }, nil
+}
+
+// readErrors reads ICMP errors about datagrams of protocol proto until the
+// prober is closed, passing those that match finds a probe for on as
+// answers.
+func (p *transportProber) readErrors(proto int, match func(header []byte) (int, bool)) {
+    p.wg.Add(1)
+    go func() {
+        defer p.wg.Done()
+        for {
+            icmpErr, header, err := p.errs.ReceiveError(p.ctx, proto, p.dest.IP, time.Minute)
+            if p.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+                return
+            }
+            if err != nil {
+                if errors.Is(err, os.ErrDeadlineExceeded) {
+                    continue
+                }
+                // Don't spin on an error that keeps coming back.
+                select {
+                case <-time.After(100 * time.Millisecond):
+                case <-p.ctx.Done():
+                    return
+                }
+                continue
+            }
+            key, ok := match(header)
+            if !ok {
+                continue
+            }
+            a := answer{key: key, from: ipString(icmpErr.From), at: time.Now()}
+            switch {
+            case a.from == p.dest.IP.String() && portUnreachable(icmpErr, p.dest.IP.To4() == nil):
+                // The probe got there and nothing was listening, which is
+                // how a UDP trace knows it is done.
+                a.reached = true
+            case icmpErr.Unreachable():
+                a.unreachable = icmpErr
+            }
+            p.deliver(a)
+        }
+    }()
+}
+
+// portUnreachable reports whether e says no socket took the probe.
+func portUnreachable(e *icmp.Error, v6 bool) bool {
+    if e.Kind != icmp.DestinationUnreachable {
+        return false
+    }
+    if v6 {
+        return e.Code == 4
+    }
+    return e.Code == icmp.CodePortUnreachable
+}
+
+// track marks key outstanding.
+func (p *transportProber) track(key int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.pending[key] = true
+}
+
+// claim marks key as answered, reporting whether it was still outstanding.
+func (p *transportProber) claim(key int) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if !p.pending[key] {
+        return false
+    }
+    delete(p.pending, key)
+    return true
+}
+
+// deliver passes a on if its probe was still waiting for an answer.
+func (p *transportProber) deliver(a answer) {
+    if !p.claim(a.key) {
+        return
+    }
+    select {
+    case p.answers <- a:
+    case <-p.ctx.Done():
+    }
+}
+
+func (p *transportProber) receive(ctx context.Context, timeout time.Duration) (answer, error) {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case a := <-p.answers:
+        return a, nil
+    case <-timer.C:
+        return answer{}, os.ErrDeadlineExceeded
+    case <-ctx.Done():
+        return answer{}, ctx.Err()
+    }
+}
+
+func (p *transportProber) forget(key int) { p.claim(key) }
+
+// shutdown stops the background readers once their sockets are closed.
+func (p *transportProber) shutdown() error {
+    p.cancel()
+    err := p.errs.Close()
+    p.wg.Wait()
+    return err
+}
+
+// setTTL returns a function that sets the TTL or hop limit of packets sent
+// on conn.
+func setTTL(conn net.PacketConn, v6 bool) func(int) error {
+    if v6 {
+        pc := ipv6.NewPacketConn(conn)
+        return pc.SetHopLimit
+    }
+    pc := ipv4.NewPacketConn(conn)
+    return pc.SetTTL
+}
+
+// setTOS sets the type of service or traffic class of packets sent on conn.
+func setTOS(conn net.PacketConn, v6 bool, tos int) error {
+    if tos == 0 {
+        return nil
+    }
+    var err error
+    if v6 {
+        err = ipv6.NewPacketConn(conn).SetTrafficClass(tos)
+    } else {
+        err = ipv4.NewPacketConn(conn).SetTOS(tos)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to set TOS: %w", err)
+    }
+    return nil
+}
+
+// udpProber sends UDP datagrams from one source port to a destination port
+// one higher for each probe, as classic traceroute does. The destination
+// answers with a port unreachable error, provided nothing listens there.
+type udpProber struct {
+    *transportProber
+    conn   *net.UDPConn
+    setTTL func(int) error
+    port   int
+    base   int
+    next   int
+    size   int
+}
+
+func newUDPProber(destAddr *net.IPAddr, o Options) (*udpProber, error) {
+    t, err := newTransportProber(destAddr, o)
+    if err != nil {
+        return nil, err
+    }
+    v6 := destAddr.IP.To4() == nil
+    network := "udp4"
+    if v6 {
+        network = "udp6"
+    }
+    conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(o.ICMP.Source), Port: o.FlowID})
+    if err != nil {
+        t.shutdown()
+        return nil, fmt.Errorf("failed to listen on UDP: %w", err)
+    }
+    if err := setTOS(conn, v6, o.TOS); err != nil {
+        conn.Close()
+        t.shutdown()
+        return nil, err
+    }
+    p := &udpProber{
+        transportProber: t,
+        conn:            conn,
+        setTTL:          setTTL(conn, v6),
+        port:            conn.LocalAddr().(*net.UDPAddr).Port,
+        base:            o.Port,
+        size:            o.Size,
+    }
+    if p.base <= 0 {
+        p.base = DefaultUDPPort
+    }
+    p.readErrors(protocolUDP, func(header []byte) (int, bool) {
+        if int(binary.BigEndian.Uint16(header[0:2])) != p.port {
+            return 0, false
+        }
+        return int(binary.BigEndian.Uint16(header[2:4])), true
+    })
+    return p, nil
+}
+
+func (p *udpProber) send(ttl int) (int, error) {
+    port := p.base + p.next%(65536-p.base)
+    p.next++
+    if err := p.setTTL(ttl); err != nil {
+        return 0, fmt.Errorf("failed to set TTL: %w", err)
+    }
+    p.track(port)
+    dst := &net.UDPAddr{IP: p.dest.IP, Port: port, Zone: p.dest.Zone}
+    if _, err := p.conn.WriteToUDP(make([]byte, p.size), dst); err != nil {
+        p.forget(port)
+        return 0, fmt.Errorf("failed to send UDP probe: %w", err)
+    }
+    return port, nil
+}
+
+func (p *udpProber) flowID() int { return p.port }
+
+func (p *udpProber) close() error {
+    p.conn.Close()
+    return p.shutdown()
+}
+
+// tcpProber sends TCP SYNs from one source port to one destination port,
+// which is as close as a probe gets to the connections an application
+// makes. Probes are told apart by their sequence numbers. The destination
+// answers with a SYN-ACK if the port is open or a RST if it is closed; the
+// kernel resets the half-open connection that leaves behind.
+type tcpProber struct {
+    *transportProber
+    conn   *net.IPConn
+    setTTL func(int) error
+    src    net.IP
+    sport  int
+    dport  int
+    size   int
+    isn    uint32
+    next   uint32
+}
+
+func newTCPProber(destAddr *net.IPAddr, o Options) (*tcpProber, error) {
+    t, err := newTransportProber(destAddr, o)
+    if err != nil {
+        return nil, err
+    }
+    v6 := destAddr.IP.To4() == nil
+    network := "ip4:tcp"
+    if v6 {
+        network = "ip6:tcp"
+    }
+    // The checksum covers our own address, so work out which one the kernel
+    // will send from unless we say.
+    src := net.ParseIP(o.ICMP.Source)
+    if src == nil {
+        src, err = icmp.SourceAddress(destAddr)
+        if err != nil {
+            t.shutdown()
+            return nil, err
+        }
+    }
+    conn, err := net.ListenIP(network, &net.IPAddr{IP: src})
+    if err != nil {
+        t.shutdown()
+        return nil, fmt.Errorf("failed to listen on packet: %w", err)
+    }
+    if err := setTOS(conn, v6, o.TOS); err != nil {
+        conn.Close()
+        t.shutdown()
+        return nil, err
+    }
+    p := &tcpProber{
+        transportProber: t,
+        conn:            conn,
+        setTTL:          setTTL(conn, v6),
+        src:             src,
+        sport:           o.FlowID,
+        dport:           o.Port,
+        size:            o.Size,
+        isn:             rand.Uint32(),
+    }
+    if p.sport == 0 {
+        p.sport = 32768 + rand.IntN(28232)
+    }
+    if p.dport <= 0 {
+        p.dport = DefaultTCPPort
+    }
+    p.readErrors(protocolTCP, func(header []byte) (int, bool) {
+        if int(binary.BigEndian.Uint16(header[0:2])) != p.sport || int(binary.BigEndian.Uint16(header[2:4])) != p.dport {
+            return 0, false
+        }
+        return int(binary.BigEndian.Uint32(header[4:8])), true
+    })
+    p.wg.Add(1)
+    go p.readReplies()
+    return p, nil
+}
+
+func (p *tcpProber) send(ttl int) (int, error) {
+    seq := p.isn + p.next
+    p.next++
+    if err := p.setTTL(ttl); err != nil {
+        return 0, fmt.Errorf("failed to set TTL: %w", err)
+    }
+    key := int(seq)
+    p.track(key)
+    if _, err := p.conn.WriteToIP(p.syn(seq), p.dest); err != nil {
+        p.forget(key)
+        return 0, fmt.Errorf("failed to send TCP probe: %w", err)
+    }
+    return key, nil
+}
+
+// syn builds a SYN segment with sequence number seq and an MSS option, which
+// some middleboxes insist on, followed by p.size bytes of data.
+func (p *tcpProber) syn(seq uint32) []byte {
+    seg := make([]byte, 24+p.size)
+    binary.BigEndian.PutUint16(seg[0:2], uint16(p.sport))
+    binary.BigEndian.PutUint16(seg[2:4], uint16(p.dport))
+    binary.BigEndian.PutUint32(seg[4:8], seq)
+    seg[12] = 6 << 4 // Data offset in 32-bit words
+    seg[13] = 0x02   // SYN
+    binary.BigEndian.PutUint16(seg[14:16], 65535)
+    seg[20], seg[21] = 2, 4 // Maximum segment size
+    binary.BigEndian.PutUint16(seg[22:24], 1460)
+    binary.BigEndian.PutUint16(seg[16:18], tcpChecksum(p.src, p.dest.IP, seg))
+    return seg
+}
+
+// tcpChecksum computes the checksum of seg over the IPv4 or IPv6
+// pseudo-header.
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+    var b []byte
+    if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+        b = append(b, src4...)
+        b = append(b, dst4...)
+        b = append(b, 0, protocolTCP)
+        b = binary.BigEndian.AppendUint16(b, uint16(len(seg)))
+    } else {
+        b = append(b, src.To16()...)
+        b = append(b, dst.To16()...)
+        b = binary.BigEndian.AppendUint32(b, uint32(len(seg)))
+        b = append(b, 0, 0, 0, protocolTCP)
+    }
+    return icmp.Checksum(append(b, seg...))
+}
+
+// readReplies reads the SYN-ACKs and RSTs the destination answers probes
+// with until the prober is closed.
+func (p *tcpProber) readReplies() {
+    defer p.wg.Done()
+    buf := make([]byte, 1500)
+    for {
+        n, from, err := p.conn.ReadFromIP(buf)
+        if p.ctx.Err() != nil {
+            return
+        }
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            continue
+        }
+        seg := buf[:n]
+        if n < 20 || !from.IP.Equal(p.dest.IP) ||
+            int(binary.BigEndian.Uint16(seg[0:2])) != p.dport || int(binary.BigEndian.Uint16(seg[2:4])) != p.sport {
+            continue
+        }
+        const syn, rst, ack = 0x02, 0x04, 0x10
+        flags := seg[13]
+        if flags&ack == 0 || flags&(syn|rst) == 0 {
+            continue
+        }
+        // A SYN-ACK acknowledges just the SYN, dropping any data it carried,
+        // but a reset acknowledges the data too.
+        acked := uint32(1)
+        if flags&syn == 0 {
+            acked += uint32(p.size)
+        }
+        key := int(binary.BigEndian.Uint32(seg[8:12]) - acked)
+        p.deliver(answer{key: key, from: from.IP.String(), at: time.Now(), reached: true})
+    }
+}
+
+func (p *tcpProber) flowID() int { return p.sport }
+
+func (p *tcpProber) close() error {
+    p.cancel()
+    p.conn.Close()
+    return p.shutdown()
+}
@@ -1,73 +1,440 @@
 package traceroute
 
 import (
+    "context"
+    "errors"
     "fmt"
     "net"
+    "slices"
     "strings"
     "time"
 
-    "golang.org/x/net/ipv4"
     "github.com/Dyst0rti0n/gonetdiag/internal/icmp"
+    "github.com/Dyst0rti0n/gonetdiag/internal/stats"
 )
 
-func TraceRoute(target string) (string, error) {
+// DefaultQueries is how many probes are sent to each hop when Options
+// doesn't say.
+const DefaultQueries = 3
+
+// DefaultSimQueries is how many probes are in flight at once when Options
+// doesn't say, as in classic traceroute.
+const DefaultSimQueries = 16
+
+// DefaultMaxHops and DefaultWait are the last hop probed and how long a probe
+// waits for its answer when Options doesn't say.
+const (
+    DefaultMaxHops = 30
+    DefaultWait    = time.Second
+)
+
+// MaxQueries, MaxSimQueries and MaxWait bound what Options may ask for, so a
+// trace requested over the web can't flood the path or hold a socket open
+// for long. MaxQueries matches traceroute(8).
+const (
+    MaxQueries    = 10
+    MaxSimQueries = 64
+    MaxWait       = time.Minute
+)
+
+// Probe is the answer to one probe sent to a hop. Addr is empty when nothing
+// answered before the wait expired.
+type Probe struct {
+    Addr string        `json:"addr,omitempty"`
+    Host string        `json:"host,omitempty"`
+    RTT  time.Duration `json:"rtt,omitempty"`
+
+    // Error is set when the hop reported that the destination is
+    // unreachable, for example "Destination Host Unreachable".
+    Error string `json:"error,omitempty"`
+}
+
+// Hop is one TTL step along the route, with a Probe for each probe sent to
+// it. Different probes may be answered by different routers.
+type Hop struct {
+    TTL      int           `json:"ttl"`
+    Probes   []Probe       `json:"probes"`
+    Sent     int           `json:"sent"`
+    Received int           `json:"received"`
+    RTT      stats.Summary `json:"rtt"`
+}
+
+// Loss returns the percentage of probes to the hop that went unanswered.
+func (h Hop) Loss() float64 {
+    if h.Sent == 0 {
+        return 0
+    }
+    return float64(h.Sent-h.Received) / float64(h.Sent) * 100
+}
+
+// Addrs returns the routers that answered at this hop, in the order they
+// first did.
+func (h Hop) Addrs() []string {
+    var addrs []string
+    for _, p := range h.Probes {
+        if p.Addr != "" && !slices.Contains(addrs, p.Addr) {
+            addrs = append(addrs, p.Addr)
+        }
+    }
+    return addrs
+}
+
+// String lists each probe's RTT after the router that answered it, as
+// classic traceroute does, followed by the hop's loss and RTT figures.
+func (h Hop) String() string {
     var sb strings.Builder
+    fmt.Fprintf(&sb, "%d:", h.TTL)
+    last := ""
+    for _, p := range h.Probes {
+        if p.Addr == "" {
+            sb.WriteString(" *")
+            continue
+        }
+        if p.Addr != last {
+            if p.Host != p.Addr {
+                fmt.Fprintf(&sb, " %s (%s)", p.Host, p.Addr)
+            } else {
+                fmt.Fprintf(&sb, " %s", p.Addr)
+            }
+            last = p.Addr
+        }
+        fmt.Fprintf(&sb, " %.3fms", stats.Milliseconds(p.RTT))
+        if p.Error != "" {
+            fmt.Fprintf(&sb, " (%s)", p.Error)
+        }
+    }
+    if h.Received > 0 {
+        fmt.Fprintf(&sb, "  [Loss = %.0f%%, Min/Avg/Max = %.3f/%.3f/%.3fms]",
+            h.Loss(), stats.Milliseconds(h.RTT.Min), stats.Milliseconds(h.RTT.Mean), stats.Milliseconds(h.RTT.Max))
+    }
+    return sb.String()
+}
 
-    destAddr, err := net.ResolveIPAddr("ip4", target)
+// Format renders hops one per line, in the classic traceroute layout.
+func Format(hops []Hop) string {
+    var sb strings.Builder
+    for _, hop := range hops {
+        sb.WriteString(hop.String())
+        sb.WriteString("\n")
+    }
+    return sb.String()
+}
+
+// Options controls a trace.
+type Options struct {
+    ICMP icmp.Options
+
+    // Method is how the route is probed: MethodICMP, the default, sends
+    // echo requests, MethodUDP datagrams to high ports and MethodTCP SYNs.
+    Method string
+
+    // Port is the destination port of TCP probes, DefaultTCPPort if zero,
+    // or the first of UDP probes, DefaultUDPPort if zero.
+    Port int
+
+    // FlowID is the ICMP identifier every echo request carries, or the
+    // source port of UDP and TCP probes. Echo requests also keep the same
+    // checksum, and TCP probes the same ports, so per-flow load balancers
+    // send them all down one path, as Paris traceroute does; picking
+    // another FlowID may pick another path. Zero lets the socket choose.
+    FlowID int
+
+    // Queries is the number of probes sent to each hop, DefaultQueries if
+    // zero.
+    Queries int
+
+    // SimQueries is the number of probes in flight at once,
+    // DefaultSimQueries if zero. Probes to several hops going out together
+    // is what lets a trace take about one wait rather than one per hop.
+    SimQueries int
+
+    // FirstTTL is the first hop probed, 1 if zero, and MaxHops the last,
+    // DefaultMaxHops if zero.
+    FirstTTL int
+    MaxHops  int
+
+    // Wait is how long each probe waits for its answer, DefaultWait if zero.
+    Wait time.Duration
+
+    // Size is the number of payload bytes each probe carries after its
+    // ICMP, UDP or TCP header. An echo request's flow word counts towards
+    // it.
+    Size int
+
+    // Source is the local address probes are sent from. Interface sends
+    // them from the address of the destination's family on that interface
+    // instead; routing still decides where they go out.
+    Source    string
+    Interface string
+
+    // TOS is the IPv4 type of service or IPv6 traffic class of probes.
+    TOS int
+
+    // NoDNS skips looking up the names of the routers that answer.
+    NoDNS bool
+}
+
+// withDefaults fills in the zero fields of o and checks the rest.
+func (o Options) withDefaults() (Options, error) {
+    if o.Queries <= 0 {
+        o.Queries = DefaultQueries
+    }
+    if o.SimQueries <= 0 {
+        o.SimQueries = DefaultSimQueries
+    }
+    if o.FirstTTL <= 0 {
+        o.FirstTTL = 1
+    }
+    if o.MaxHops <= 0 {
+        o.MaxHops = DefaultMaxHops
+    }
+    if o.Wait <= 0 {
+        o.Wait = DefaultWait
+    }
+    switch {
+    case o.Queries > MaxQueries:
+        return o, fmt.Errorf("%d queries per hop is over %d", o.Queries, MaxQueries)
+    case o.SimQueries > MaxSimQueries:
+        return o, fmt.Errorf("%d simultaneous queries is over %d", o.SimQueries, MaxSimQueries)
+    case o.Wait > MaxWait:
+        return o, fmt.Errorf("wait %v is over %v", o.Wait, MaxWait)
+    case o.MaxHops > 255:
+        return o, fmt.Errorf("max hops %d is over 255", o.MaxHops)
+    case o.FirstTTL > o.MaxHops:
+        return o, fmt.Errorf("first TTL %d is beyond max hops %d", o.FirstTTL, o.MaxHops)
+    case o.Size < 0 || o.Size > 65000:
+        return o, fmt.Errorf("probe size %d is not between 0 and 65000", o.Size)
+    case o.Port < 0 || o.Port > 65535:
+        return o, fmt.Errorf("port %d is not between 0 and 65535", o.Port)
+    case o.FlowID < 0 || o.FlowID > 65535:
+        return o, fmt.Errorf("flow ID %d is not between 0 and 65535", o.FlowID)
+    case o.TOS < 0 || o.TOS > 255:
+        return o, fmt.Errorf("TOS %d is not between 0 and 255", o.TOS)
+    case o.Source != "" && o.Interface != "":
+        return o, errors.New("source address and interface are mutually exclusive")
+    }
+    if o.Source != "" {
+        o.ICMP.Source = o.Source
+    }
+    return o, nil
+}
+
+// TraceRoute traces the route to target with default options.
+func TraceRoute(target string, opts icmp.Options) ([]Hop, error) {
+    return Trace(context.Background(), target, Options{ICMP: opts})
+}
+
+// Trace sends probes to target with increasing TTLs and records who answers
+// each one, until the destination does or reports it can't be reached. It
+// gives up with ctx's error if ctx is done first.
+func Trace(ctx context.Context, target string, o Options) ([]Hop, error) {
+    o, err := o.withDefaults()
+    if err != nil {
+        return nil, err
+    }
+    t, err := newTracer(target, o)
     if err != nil {
-        return "", fmt.Errorf("failed to resolve target: %w", err)
+        return nil, err
     }
+    defer t.close()
+    return t.trace(ctx, o)
+}
+
+// tracer probes one destination with a single prober, so every probe
+// belongs to the same flow.
+type tracer struct {
+    prober prober
+    dest   *net.IPAddr
+    noDNS  bool
+    names  map[string]string
+}
 
-    for ttl := 1; ttl <= 30; ttl++ {
-        conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+// newTracer resolves target and opens the prober for o.Method. o must have
+// its defaults filled in.
+func newTracer(target string, o Options) (*tracer, error) {
+    destAddr, err := icmp.Resolve(target, o.ICMP)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve target: %w", err)
+    }
+    if o.Interface != "" {
+        o.ICMP.Source, err = interfaceAddress(o.Interface, destAddr.IP.To4() == nil)
         if err != nil {
-            return "", fmt.Errorf("failed to listen on packet: %w", err)
+            return nil, err
+        }
+    }
+    p, err := newProber(destAddr, o)
+    if err != nil {
+        return nil, err
+    }
+    return &tracer{prober: p, dest: destAddr, noDNS: o.NoDNS, names: make(map[string]string)}, nil
+}
+
+// interfaceAddress returns the first IPv4 or IPv6 address of the interface
+// called name. IPv6 link-local addresses are passed over, as they can't
+// reach beyond the link.
+func interfaceAddress(name string, v6 bool) (string, error) {
+    ifi, err := net.InterfaceByName(name)
+    if err != nil {
+        return "", fmt.Errorf("failed to find interface: %w", err)
+    }
+    addrs, err := ifi.Addrs()
+    if err != nil {
+        return "", fmt.Errorf("failed to list addresses of %s: %w", name, err)
+    }
+    for _, addr := range addrs {
+        ipNet, ok := addr.(*net.IPNet)
+        if !ok || (ipNet.IP.To4() == nil) != v6 || (v6 && ipNet.IP.IsLinkLocalUnicast()) {
+            continue
         }
-        defer conn.Close()
+        return ipNet.IP.String(), nil
+    }
+    family := "IPv4"
+    if v6 {
+        family = "IPv6"
+    }
+    return "", fmt.Errorf("interface %s has no usable %s address", name, family)
+}
+
+func (t *tracer) close() error {
+    return t.prober.close()
+}
 
-        pconn := ipv4.NewPacketConn(conn)
-        if err := pconn.SetTTL(ttl); err != nil {
-            return "", fmt.Errorf("failed to set TTL: %w", err)
+// host returns the name addr reverse-resolves to, or addr itself, looking
+// each address up only once.
+func (t *tracer) host(addr string) string {
+    if t.noDNS {
+        return addr
+    }
+    host, ok := t.names[addr]
+    if !ok {
+        host = addr
+        if found, err := net.LookupAddr(addr); err == nil && len(found) > 0 {
+            host = found[0]
         }
+        t.names[addr] = host
+    }
+    return host
+}
 
-        start := time.Now()
-        if err := icmp.SendICMPRequest(pconn, destAddr, ttl); err != nil {
-            return "", fmt.Errorf("failed to send ICMP request: %w", err)
+// trace probes TTLs from o.FirstTTL to o.MaxHops with o.Queries probes
+// each, keeping up to o.SimQueries probes in flight at once and matching
+// answers to probes by their keys. Once the destination answers, or a hop
+// reports it can't be reached, nothing further along is probed or waited
+// for. o must have its defaults filled in.
+func (t *tracer) trace(ctx context.Context, o Options) ([]Hop, error) {
+    wait := o.Wait
+
+    type inFlight struct {
+        ttl, query int
+        sent       time.Time
+    }
+    hops := make([]Hop, o.MaxHops-o.FirstTTL+1)
+    for i := range hops {
+        hops[i] = Hop{TTL: o.FirstTTL + i, Probes: make([]Probe, o.Queries)}
+    }
+    hop := func(ttl int) *Hop { return &hops[ttl-o.FirstTTL] }
+    pending := make(map[int]inFlight)
+    last := o.MaxHops // the highest TTL still worth probing
+    next := 0         // the next probe to send, counting across TTLs
+    for {
+        for len(pending) < o.SimQueries && o.FirstTTL+next/o.Queries <= last {
+            ttl, query := o.FirstTTL+next/o.Queries, next%o.Queries
+            at := time.Now()
+            key, err := t.prober.send(ttl)
+            if err != nil {
+                return nil, err
+            }
+            pending[key] = inFlight{ttl: ttl, query: query, sent: at}
+            hop(ttl).Sent++
+            next++
+        }
+        if len(pending) == 0 {
+            break
         }
 
-        addr, err := receiveAddress(pconn, time.Second)
+        oldest := time.Time{}
+        for _, p := range pending {
+            if oldest.IsZero() || p.sent.Before(oldest) {
+                oldest = p.sent
+            }
+        }
+        a, err := t.prober.receive(ctx, time.Until(oldest.Add(wait)))
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
         if err != nil {
-            sb.WriteString(fmt.Sprintf("%d: * * *\n", ttl))
+            // Give up on whatever has waited long enough, so a late answer
+            // isn't taken for a later probe's.
+            for key, p := range pending {
+                if time.Since(p.sent) >= wait {
+                    t.prober.forget(key)
+                    delete(pending, key)
+                }
+            }
             continue
         }
-
-        host, err := net.LookupAddr(addr)
-        if err != nil || len(host) == 0 {
-            host = []string{addr}
+        p, ok := pending[a.key]
+        if !ok {
+            continue
         }
+        delete(pending, a.key)
 
-        RTT := time.Since(start)
-        sb.WriteString(fmt.Sprintf("%d: %s, RTT = %v\n", ttl, host[0], RTT))
-        if addr == destAddr.String() {
-            break
+        probe := Probe{Addr: a.from, RTT: a.at.Sub(p.sent)}
+        if a.unreachable != nil {
+            probe.Error = a.unreachable.Message()
+        }
+        hop(p.ttl).Probes[p.query] = probe
+        hop(p.ttl).Received++
+        // Stop at the destination, or where the route turned out to end.
+        if (a.reached || a.unreachable != nil) && p.ttl < last {
+            last = p.ttl
+            for key, p := range pending {
+                if p.ttl > last {
+                    t.prober.forget(key)
+                    delete(pending, key)
+                }
+            }
         }
     }
 
-    return sb.String(), nil
+    // Names are looked up once every answer is in, so the lookups don't
+    // hold up reading them.
+    hops = hops[:last-o.FirstTTL+1]
+    for i := range hops {
+        var rtts []time.Duration
+        for j, probe := range hops[i].Probes {
+            if probe.Addr != "" {
+                hops[i].Probes[j].Host = t.host(probe.Addr)
+                rtts = append(rtts, probe.RTT)
+            }
+        }
+        hops[i].RTT = stats.Summarize(rtts)
+    }
+    return hops, nil
 }
 
-func receiveAddress(conn *ipv4.PacketConn, timeout time.Duration) (string, error) {
-    conn.SetReadDeadline(time.Now().Add(timeout))
-    buf := make([]byte, 512)
-    _, cm, src, err := conn.ReadFrom(buf)
-    if err != nil {
-        return "", err
+// receiveAddress waits for the echo reply from the destination, or the ICMP
+// error a router sent about one of our requests, and returns the request's
+// sequence number and who answered it. When that error says the destination
+// cannot be reached it is returned as well.
+func receiveAddress(ctx context.Context, session *icmp.Session, timeout time.Duration) (int, string, *icmp.Error, error) {
+    reply, err := session.ReceiveICMPReply(ctx, timeout)
+    var icmpErr *icmp.Error
+    if errors.As(err, &icmpErr) {
+        if icmpErr.Unreachable() {
+            return icmpErr.Seq, ipString(icmpErr.From), icmpErr, nil
+        }
+        return icmpErr.Seq, ipString(icmpErr.From), nil, nil
     }
-    if cm == nil {
-        return "", fmt.Errorf("control message is nil")
+    if err != nil {
+        return 0, "", nil, err
     }
-    if cm.TTL == 0 {
-        return "", fmt.Errorf("TTL expired")
+    return reply.Seq, ipString(reply.Addr), nil, nil
+}
+
+func ipString(addr net.Addr) string {
+    if addr == nil {
+        return ""
     }
-    return src.String(), nil
+    return addr.String()
 }
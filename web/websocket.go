@@ -1,13 +1,16 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Dyst0rti0n/gonetdiag/internal/bandwidth"
+	"github.com/Dyst0rti0n/gonetdiag/internal/icmp"
 	"github.com/Dyst0rti0n/gonetdiag/internal/latency"
 	"github.com/Dyst0rti0n/gonetdiag/internal/packetloss"
 	"github.com/Dyst0rti0n/gonetdiag/internal/ping"
@@ -60,20 +63,31 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 			action := request["action"]
 			target := request["target"]
+			opts := icmp.Options{Network: request["network"]}
 
 			switch action {
 			case "ping":
-				go handlePingWebSocket(ws, target)
+				go handlePingWebSocket(ws, target, opts)
 			case "traceroute":
-				go handleTracerouteWebSocket(ws, target)
+				trace, err := traceOptions(func(key string) string { return request[key] }, opts)
+				if err != nil {
+					sendError(ws, err)
+					continue
+				}
+				go handleTracerouteWebSocket(ws, target, trace)
 			case "bandwidth":
 				go handleBandwidthWebSocket(ws, target)
 			case "latency":
-				go handleLatencyWebSocket(ws, target)
+				go handleLatencyWebSocket(ws, target, opts)
 			case "packetloss":
-				go handlePacketLossWebSocket(ws, target)
+				go handlePacketLossWebSocket(ws, target, opts)
 			case "report":
-				go handleReportWebSocket(ws, target)
+				trace, err := traceOptions(func(key string) string { return request[key] }, opts)
+				if err != nil {
+					sendError(ws, err)
+					continue
+				}
+				go handleReportWebSocket(ws, target, opts, trace)
 			default:
 				log.Println("Unknown action:", action)
 			}
@@ -81,10 +95,10 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}).ServeHTTP(w, r)
 }
 
-func handlePingWebSocket(ws *websocket.Conn, target string) {
+func handlePingWebSocket(ws *websocket.Conn, target string, opts icmp.Options) {
 	count := 4
 	timeout := 5 * time.Second
-	result, err := ping.Ping(target, count, timeout)
+	result, err := ping.Ping(context.Background(), target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 	if err != nil {
 		sendError(ws, err)
 		return
@@ -92,24 +106,71 @@ func handlePingWebSocket(ws *websocket.Conn, target string) {
 	sendResult(ws, "Ping Result", result)
 }
 
-func handleTracerouteWebSocket(ws *websocket.Conn, target string) {
-	result, err := traceroute.TraceRoute(target)
+// traceOptions builds traceroute options from the request parameters named
+// after the CLI's flags, with underscores for dashes. Missing parameters keep
+// their defaults.
+func traceOptions(param func(string) string, opts icmp.Options) (traceroute.Options, error) {
+	o := traceroute.Options{
+		ICMP:      opts,
+		Method:    param("method"),
+		Source:    param("source"),
+		Interface: param("interface"),
+	}
+	ints := map[string]*int{
+		"port":        &o.Port,
+		"flow_id":     &o.FlowID,
+		"queries":     &o.Queries,
+		"sim_queries": &o.SimQueries,
+		"first_ttl":   &o.FirstTTL,
+		"max_hops":    &o.MaxHops,
+		"size":        &o.Size,
+		"tos":         &o.TOS,
+	}
+	for key, v := range ints {
+		if param(key) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(param(key))
+		if err != nil {
+			return o, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*v = n
+	}
+	if w := param("wait"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			return o, fmt.Errorf("invalid wait: %w", err)
+		}
+		o.Wait = d
+	}
+	if n := param("no_dns"); n != "" {
+		b, err := strconv.ParseBool(n)
+		if err != nil {
+			return o, fmt.Errorf("invalid no_dns: %w", err)
+		}
+		o.NoDNS = b
+	}
+	return o, nil
+}
+
+func handleTracerouteWebSocket(ws *websocket.Conn, target string, opts traceroute.Options) {
+	hops, err := traceroute.Trace(context.Background(), target, opts)
 	if err != nil {
 		sendError(ws, err)
 		return
 	}
-	sendResult(ws, "Traceroute Result", result)
+	sendResult(ws, "Traceroute Result", hops)
 }
 
 func handleBandwidthWebSocket(ws *websocket.Conn, target string) {
-	uploadResult, err := bandwidth.MeasureUploadBandwidth(target)
+	uploadResult, err := bandwidth.MeasureHTTPUploadBandwidth(context.Background(), target, "http", bandwidth.Options{})
 	if err != nil {
 		sendError(ws, err)
 		return
 	}
 	sendResult(ws, "Upload Bandwidth Result", uploadResult)
 
-	downloadResult, err := bandwidth.MeasureDownloadBandwidth(target, "http")
+	downloadResult, err := bandwidth.MeasureDownloadBandwidth(context.Background(), target, "http", bandwidth.Options{})
 	if err != nil {
 		sendError(ws, err)
 		return
@@ -117,10 +178,10 @@ func handleBandwidthWebSocket(ws *websocket.Conn, target string) {
 	sendResult(ws, "Download Bandwidth Result", downloadResult)
 }
 
-func handleLatencyWebSocket(ws *websocket.Conn, target string) {
+func handleLatencyWebSocket(ws *websocket.Conn, target string, opts icmp.Options) {
 	count := 4
 	timeout := 5 * time.Second
-	result, err := latency.AnalyzeLatency(target, count, timeout)
+	result, err := latency.AnalyzeLatency(target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 	if err != nil {
 		sendError(ws, err)
 		return
@@ -128,10 +189,10 @@ func handleLatencyWebSocket(ws *websocket.Conn, target string) {
 	sendResult(ws, "Latency Result", result)
 }
 
-func handlePacketLossWebSocket(ws *websocket.Conn, target string) {
+func handlePacketLossWebSocket(ws *websocket.Conn, target string, opts icmp.Options) {
 	count := 4
 	timeout := 5 * time.Second
-	result, err := packetloss.DetectPacketLoss(target, count, timeout)
+	result, err := packetloss.DetectPacketLoss(target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 	if err != nil {
 		sendError(ws, err)
 		return
@@ -139,39 +200,41 @@ func handlePacketLossWebSocket(ws *websocket.Conn, target string) {
 	sendResult(ws, "Packet Loss Result", result)
 }
 
-func handleReportWebSocket(ws *websocket.Conn, target string) {
-	var pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult string
-	var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr error
-
-	pingResult, pingErr = ping.Ping(target, 4, 5*time.Second)
-	traceResult, traceErr = traceroute.TraceRoute(target)
-	uploadResult, uploadErr := bandwidth.MeasureUploadBandwidth(target)
-	if uploadErr != nil {
-		bandwidthErr = uploadErr
-	} else {
-		downloadResult, downloadErr := bandwidth.MeasureDownloadBandwidth(target, "http")
-		if downloadErr != nil {
-			bandwidthErr = downloadErr
-		} else {
-			bandwidthResult = fmt.Sprintf("%s\n%s", uploadResult, downloadResult)
-		}
-	}
-	latencyResult, latencyErr = latency.AnalyzeLatency(target, 4, 5*time.Second)
-	packetLossResult, packetLossErr = packetloss.DetectPacketLoss(target, 4, 5*time.Second)
-
-	if pingErr != nil || traceErr != nil || bandwidthErr != nil || latencyErr != nil || packetLossErr != nil {
-		sendError(ws, fmt.Errorf("Error in generating report: pingErr=%v, traceErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v",
-			pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr))
+func handleReportWebSocket(ws *websocket.Conn, target string, opts icmp.Options, trace traceroute.Options) {
+	r, err := collectReport(target, opts, trace)
+	if err != nil {
+		sendError(ws, err)
 		return
 	}
 
-	err := report.GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult)
+	err = report.GenerateReport(r)
 	if err != nil {
 		sendError(ws, err)
 		return
 	}
 
-	sendResult(ws, "Report generated successfully!", "")
+	sendResult(ws, "Report generated successfully!", r)
+}
+
+// collectReport runs every diagnostic against target in turn.
+func collectReport(target string, opts icmp.Options, trace traceroute.Options) (*report.Report, error) {
+	r := &report.Report{Target: target}
+	var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr error
+
+	r.Ping, pingErr = ping.Ping(context.Background(), target, ping.Options{Count: 4, Timeout: 5 * time.Second, ICMP: opts})
+	r.Trace, traceErr = traceroute.Trace(context.Background(), target, trace)
+	r.Upload, bandwidthErr = bandwidth.MeasureHTTPUploadBandwidth(context.Background(), target, "http", bandwidth.Options{})
+	if bandwidthErr == nil {
+		r.Download, bandwidthErr = bandwidth.MeasureDownloadBandwidth(context.Background(), target, "http", bandwidth.Options{})
+	}
+	r.Latency, latencyErr = latency.AnalyzeLatency(target, ping.Options{Count: 4, Timeout: 5 * time.Second, ICMP: opts})
+	r.PacketLoss, packetLossErr = packetloss.DetectPacketLoss(target, ping.Options{Count: 4, Timeout: 5 * time.Second, ICMP: opts})
+
+	if pingErr != nil || traceErr != nil || bandwidthErr != nil || latencyErr != nil || packetLossErr != nil {
+		return nil, fmt.Errorf("Error in generating report: pingErr=%v, traceErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v",
+			pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr)
+	}
+	return r, nil
 }
 
 func sendError(ws *websocket.Conn, err error) {
@@ -180,14 +243,15 @@ func sendError(ws *websocket.Conn, err error) {
 	websocket.Message.Send(ws, string(jsonMessage))
 }
 
-func sendResult(ws *websocket.Conn, resultType, result string) {
-	message := map[string]string{"type": resultType, "value": result}
+func sendResult(ws *websocket.Conn, resultType string, result interface{}) {
+	message := map[string]interface{}{"type": resultType, "value": result}
 	jsonMessage, _ := json.Marshal(message)
 	websocket.Message.Send(ws, string(jsonMessage))
 }
 
 func handlePing(c *gin.Context) {
 	target := c.Param("target")
+	opts := icmp.Options{Network: c.Query("network")}
 
 	go func() {
 		ws, err := websocket.Dial("ws://localhost:8080/ws", "", "http://localhost/")
@@ -199,18 +263,23 @@ func handlePing(c *gin.Context) {
 
 		count := 4
 		timeout := 5 * time.Second
-		result, err := ping.Ping(target, count, timeout)
+		result, err := ping.Ping(context.Background(), target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 		if err != nil {
 			websocket.Message.Send(ws, "Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, result)
+		websocket.Message.Send(ws, result.String())
 	}()
 }
 
 func handleTraceroute(c *gin.Context) {
 	target := c.Param("target")
+	opts, err := traceOptions(c.Query, icmp.Options{Network: c.Query("network")})
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	go func() {
 		ws, err := websocket.Dial("ws://localhost:8080/ws", "", "http://localhost/")
@@ -220,13 +289,13 @@ func handleTraceroute(c *gin.Context) {
 		}
 		defer ws.Close()
 
-		result, err := traceroute.TraceRoute(target)
+		hops, err := traceroute.Trace(context.Background(), target, opts)
 		if err != nil {
 			websocket.Message.Send(ws, "Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, result)
+		websocket.Message.Send(ws, traceroute.Format(hops))
 	}()
 }
 
@@ -241,26 +310,27 @@ func handleBandwidth(c *gin.Context) {
 		}
 		defer ws.Close()
 
-		uploadResult, err := bandwidth.MeasureUploadBandwidth(target)
+		uploadResult, err := bandwidth.MeasureHTTPUploadBandwidth(context.Background(), target, "http", bandwidth.Options{})
 		if err != nil {
 			websocket.Message.Send(ws, "Upload Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, uploadResult)
+		websocket.Message.Send(ws, uploadResult.String())
 
-		downloadResult, err := bandwidth.MeasureDownloadBandwidth(target, "http")
+		downloadResult, err := bandwidth.MeasureDownloadBandwidth(context.Background(), target, "http", bandwidth.Options{})
 		if err != nil {
 			websocket.Message.Send(ws, "Download Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, downloadResult)
+		websocket.Message.Send(ws, downloadResult.String())
 	}()
 }
 
 func handleLatency(c *gin.Context) {
 	target := c.Param("target")
+	opts := icmp.Options{Network: c.Query("network")}
 
 	go func() {
 		ws, err := websocket.Dial("ws://localhost:8080/ws", "", "http://localhost/")
@@ -272,18 +342,19 @@ func handleLatency(c *gin.Context) {
 
 		count := 4
 		timeout := 5 * time.Second
-		result, err := latency.AnalyzeLatency(target, count, timeout)
+		result, err := latency.AnalyzeLatency(target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 		if err != nil {
 			websocket.Message.Send(ws, "Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, result)
+		websocket.Message.Send(ws, result.String())
 	}()
 }
 
 func handlePacketLoss(c *gin.Context) {
 	target := c.Param("target")
+	opts := icmp.Options{Network: c.Query("network")}
 
 	go func() {
 		ws, err := websocket.Dial("ws://localhost:8080/ws", "", "http://localhost/")
@@ -295,18 +366,24 @@ func handlePacketLoss(c *gin.Context) {
 
 		count := 4
 		timeout := 5 * time.Second
-		result, err := packetloss.DetectPacketLoss(target, count, timeout)
+		result, err := packetloss.DetectPacketLoss(target, ping.Options{Count: count, Timeout: timeout, ICMP: opts})
 		if err != nil {
 			websocket.Message.Send(ws, "Error: "+err.Error())
 			return
 		}
 
-		websocket.Message.Send(ws, result)
+		websocket.Message.Send(ws, result.String())
 	}()
 }
 
 func handleReport(c *gin.Context) {
 	target := c.Param("target")
+	opts := icmp.Options{Network: c.Query("network")}
+	trace, err := traceOptions(c.Query, opts)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	go func() {
 		ws, err := websocket.Dial("ws://localhost:8080/ws", "", "http://localhost/")
@@ -316,32 +393,13 @@ func handleReport(c *gin.Context) {
 		}
 		defer ws.Close()
 
-		var pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult string
-		var pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr error
-
-		pingResult, pingErr = ping.Ping(target, 4, 5*time.Second)
-		traceResult, traceErr = traceroute.TraceRoute(target)
-		uploadResult, uploadErr := bandwidth.MeasureUploadBandwidth(target)
-		if uploadErr != nil {
-			bandwidthErr = uploadErr
-		} else {
-			downloadResult, downloadErr := bandwidth.MeasureDownloadBandwidth(target, "http")
-			if downloadErr != nil {
-				bandwidthErr = downloadErr
-			} else {
-				bandwidthResult = fmt.Sprintf("%s\n%s", uploadResult, downloadResult)
-			}
-		}
-		latencyResult, latencyErr = latency.AnalyzeLatency(target, 4, 5*time.Second)
-		packetLossResult, packetLossErr = packetloss.DetectPacketLoss(target, 4, 5*time.Second)
-
-		if pingErr != nil || traceErr != nil || bandwidthErr != nil || latencyErr != nil || packetLossErr != nil {
-			websocket.Message.Send(ws, fmt.Sprintf("Error in generating report: pingErr=%v, traceErr=%v, bandwidthErr=%v, latencyErr=%v, packetLossErr=%v",
-				pingErr, traceErr, bandwidthErr, latencyErr, packetLossErr))
+		r, err := collectReport(target, opts, trace)
+		if err != nil {
+			websocket.Message.Send(ws, err.Error())
 			return
 		}
 
-		err = report.GenerateReport(target, pingResult, traceResult, bandwidthResult, latencyResult, packetLossResult)
+		err = report.GenerateReport(r)
 		if err != nil {
 			websocket.Message.Send(ws, "Report generation error: "+err.Error())
 			return